@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// the node agent subcommand, run on the nodes by the LXCFS DaemonSet
+const agentCommand = "agent"
+
+const (
+	agentActionRemount = "remount" // remount the broken and missing LXCFS files after LXCFS started
+	agentActionUmount  = "umount"  // unmount the LXCFS files before LXCFS stopped
+	agentActionWatch   = "watch"   // watch LXCFS and repair the stale LXCFS files until stopped
+)
+
+var agentActions = []string{agentActionRemount, agentActionUmount, agentActionWatch}
+
+// the file system type of LXCFS in mount table
+const lxcfsFsType = "fuse.lxcfs"
+
+// the lock file locked when adjusting the LXCFS mounts, in a host directory not mounted into the pods,
+// which could hold the lock forever otherwise
+const defaultAgentLockFile = "/run/lxcfs-agent/agent.lock"
+
+// the interval to retry locking the lock file held by another agent process
+var agentLockRetryPeriod = 100 * time.Millisecond
+
+// mountInfo the mount point in the mount table of /proc/<pid>/mountinfo
+type mountInfo struct {
+	mountPoint string
+	fsType     string
+	root       string // the path in the file system mounted, e.g. the source of bind mount
+}
+
+// containerMounter inspect and change the mounts in the mount namespace of the process pid
+type containerMounter interface {
+	mounts(pid int) ([]mountInfo, error)
+	connected(pid int, file string) bool // false if the file not exist or its FUSE connection lost
+	unmount(pid int, target string) error
+	bindMount(pid int, source, target string) error
+}
+
+// nsenterMounter change the mounts by nsenter, as a multi-threaded Go process can't join another mount namespace.
+// The umount and mount commands of the container are run, the same as lxcfs-mount.sh did.
+type nsenterMounter struct {
+	procRoot string // the proc file system of host PID namespace
+}
+
+func (m nsenterMounter) mounts(pid int) ([]mountInfo, error) {
+	f, err := os.Open(filepath.Join(m.procRoot, strconv.Itoa(pid), "mountinfo"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMountInfo(f)
+}
+
+func (m nsenterMounter) connected(pid int, file string) bool {
+	_, err := os.Stat(filepath.Join(m.procRoot, strconv.Itoa(pid), "root", file))
+	return err == nil
+}
+
+func (m nsenterMounter) unmount(pid int, target string) error {
+	return nsenter(pid, "umount", target)
+}
+
+func (m nsenterMounter) bindMount(pid int, source, target string) error {
+	return nsenter(pid, "mount", "-B", "-o", "ro", source, target)
+}
+
+func nsenter(pid int, command ...string) error {
+	args := append([]string{"-t", strconv.Itoa(pid), "-m", "--"}, command...)
+	if out, err := exec.Command("nsenter", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", strings.Join(command, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// parseMountInfo parse the mount points, file system types and roots of mountinfo, see proc(5)
+func parseMountInfo(r io.Reader) ([]mountInfo, error) {
+	var mounts []mountInfo
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// the optional fields end with separator "-", followed by file system type
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+1 >= len(fields) {
+			return nil, fmt.Errorf("invalid mountinfo line %q", scanner.Text())
+		}
+		mounts = append(mounts, mountInfo{
+			mountPoint: unescapeMountPath(fields[4]),
+			fsType:     fields[sep+1],
+			root:       unescapeMountPath(fields[3]),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath decode the octal escapes of space, tab, newline and backslash in mountinfo
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// lxcfsAgent adjust the LXCFS bind mounts in the containers of the mutated pods on the node
+type lxcfsAgent struct {
+	runtime          runtimeapi.RuntimeServiceClient
+	mounter          containerMounter
+	mount            *lxcfsMount
+	lxcfsPods        labels.Selector // the LXCFS pods are skipped
+	pid              int             // the agent process, sees the LXCFS mount point of host
+	lockFile         string          // serialize adjusting the LXCFS mounts on the node, no lock if empty
+	annotationPrefix string          // the annotation prefix configured for the webhook, the default if empty
+}
+
+// lockMounts lock the lock file exclusively, so the agent processes on the node, e.g. the watchdog
+// and the supervisor, don't adjust the LXCFS mounts at the same time. It retries until ctx done if locked by others.
+func (a *lxcfsAgent) lockMounts(ctx context.Context) (unlock func(), err error) {
+	if a.lockFile == "" {
+		return func() {}, nil
+	}
+	f, err := os.OpenFile(a.lockFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			_ = f.Close()
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			_ = f.Close()
+			return nil, ctx.Err()
+		case <-time.After(agentLockRetryPeriod):
+		}
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		_ = f.Close()
+	}, nil
+}
+
+// source the LXCFS file on host, seen at the same path in the containers
+func (a *lxcfsAgent) source(file string) string {
+	return path.Join(a.mount.hostRoot, a.mount.mountDir, file)
+}
+
+// lxcfsMounted check whether LXCFS is mounted and connected
+func (a *lxcfsAgent) lxcfsMounted() (bool, error) {
+	mounts, err := a.mounter.mounts(a.pid)
+	if err != nil {
+		return false, err
+	}
+	mountPoint := a.source("/")
+	for _, m := range mounts {
+		if path.Clean(m.mountPoint) == mountPoint && m.fsType == lxcfsFsType {
+			return a.mounter.connected(a.pid, mountPoint), nil
+		}
+	}
+	return false, nil
+}
+
+// lxcfsMounts count the LXCFS mounts of every mount point in the mount namespace of pid, the stacked ones counted
+func (a *lxcfsAgent) lxcfsMounts(pid int) (map[string]int, error) {
+	mounts, err := a.mounter.mounts(pid)
+	if err != nil {
+		return nil, err
+	}
+	mounted := make(map[string]int)
+	for _, m := range mounts {
+		if m.fsType == lxcfsFsType {
+			mounted[m.mountPoint]++
+		}
+	}
+	return mounted, nil
+}
+
+// staleFiles the LXCFS files lost FUSE connection in container
+func (a *lxcfsAgent) staleFiles(c lxcfsContainer) ([]string, error) {
+	mounted, err := a.lxcfsMounts(c.pid)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, file := range c.files {
+		if mounted[file] > 0 && !a.mounter.connected(c.pid, file) {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// missingFiles the LXCFS files not mounted in container
+func (a *lxcfsAgent) missingFiles(c lxcfsContainer) ([]string, error) {
+	mounted, err := a.lxcfsMounts(c.pid)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, file := range c.files {
+		if mounted[file] == 0 {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// strayMounts count the mounts of the stray entries in the mount point of every LXCFS file in container,
+// i.e. the plain directories created by kubelet for the subPath if the pod started before LXCFS mounted
+func (a *lxcfsAgent) strayMounts(c lxcfsContainer) (map[string]int, error) {
+	mounts, err := a.mounter.mounts(c.pid)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool, len(c.files))
+	for _, file := range c.files {
+		wanted[file] = true
+	}
+	stray := make(map[string]int)
+	for _, m := range mounts {
+		if !wanted[m.mountPoint] || m.fsType == lxcfsFsType {
+			continue
+		}
+		// the root of the entry removed is suffixed with //deleted
+		root := strings.TrimSuffix(m.root, "//deleted")
+		if strings.HasSuffix(root, path.Join("/", a.mount.mountDir, m.mountPoint)) {
+			stray[m.mountPoint]++
+		}
+	}
+	return stray, nil
+}
+
+// strayFiles the LXCFS files in container mounted from the stray entries in the mount point
+func (a *lxcfsAgent) strayFiles(c lxcfsContainer) ([]string, error) {
+	stray, err := a.strayMounts(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, file := range c.files {
+		if stray[file] > 0 {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// umount unmount all the LXCFS files in container, return the files unmounted
+func (a *lxcfsAgent) umount(c lxcfsContainer) (files []string, err error) {
+	mounted, err := a.lxcfsMounts(c.pid)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, f := range lxcfsFileCatalogue {
+		for n := mounted[f.path]; n > 0; n-- {
+			if err := a.mounter.unmount(c.pid, f.path); err != nil {
+				errs = append(errs, err)
+				break
+			}
+			files = append(files, f.path)
+		}
+	}
+	return files, utilerrors.NewAggregate(errs)
+}
+
+// remount unmount the LXCFS files lost FUSE connection or mounted from the stray entries in container,
+// and bind-mount the files not mounted, return the files mounted
+func (a *lxcfsAgent) remount(c lxcfsContainer) (files []string, err error) {
+	mounted, err := a.lxcfsMounts(c.pid)
+	if err != nil {
+		return nil, err
+	}
+	stray, err := a.strayMounts(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, file := range c.files {
+		// the stray directories mounted by kubelet before LXCFS mounted, on the top of the LXCFS mounts if any
+		s := stray[file]
+		for ; s > 0; s-- {
+			if err := a.mounter.unmount(c.pid, file); err != nil {
+				errs = append(errs, err)
+				break
+			}
+		}
+		if s > 0 {
+			continue
+		}
+
+		n := mounted[file]
+		// the stale mounts left by the LXCFS stopped, maybe stacked by the remounts before
+		for ; n > 0 && !a.mounter.connected(c.pid, file); n-- {
+			if err := a.mounter.unmount(c.pid, file); err != nil {
+				errs = append(errs, err)
+				break
+			}
+		}
+		if n > 0 {
+			// the LXCFS file uncovered by unmounting the stray directories is mounted again
+			if stray[file] > 0 {
+				files = append(files, file)
+			}
+			continue
+		}
+
+		source := a.source(file)
+		if !a.mounter.connected(c.pid, source) {
+			errs = append(errs, fmt.Errorf("LXCFS file %s not available in container", source))
+			continue
+		}
+		if err := a.mounter.bindMount(c.pid, source, file); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		files = append(files, file)
+	}
+	return files, utilerrors.NewAggregate(errs)
+}
+
+// run adjust the LXCFS mounts of all the mutated containers by action, the containers failed are returned in error
+func (a *lxcfsAgent) run(ctx context.Context, action string) error {
+	unlock, err := a.lockMounts(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %v", a.lockFile, err)
+	}
+	defer unlock()
+
+	containers, err := lxcfsContainers(ctx, a.runtime, a.lxcfsPods, a.mount, a.annotationPrefix)
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, c := range containers {
+		log := defaultLogger.with("namespace", c.podNamespace, "pod", c.podName, "container", c.name, "pid", c.pid)
+
+		var files []string
+		var err error
+		switch action {
+		case agentActionUmount:
+			files, err = a.umount(c)
+		case agentActionRemount:
+			files, err = a.remount(c)
+		default:
+			return fmt.Errorf("unknown agent action %q, should be one of %v", action, agentActions)
+		}
+		if len(files) > 0 {
+			log.info("Adjusted LXCFS mounts in container", "action", action, "files", strings.Join(files, ","))
+		}
+		if err != nil {
+			log.warning("Failed to adjust LXCFS mounts in container", "action", action, "error", err)
+			errs = append(errs, fmt.Errorf("container %s of pod %s/%s: %v", c.name, c.podNamespace, c.podName, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// agentParameters the parameters of the subcommands adjusting the LXCFS mounts in containers
+type agentParameters struct {
+	runtimeEndpoint  string
+	runtimeTimeout   time.Duration
+	lxcfsHostRoot    string
+	lxcfsMountDir    string
+	lxcfsPodSelector string
+	procRoot         string
+	lockFile         string
+	annotationPrefix string
+	logFormat        string
+	logLevel         string
+}
+
+// addFlags add the agent flags to flags, with the klog flags
+func (p *agentParameters) addFlags(flags *flag.FlagSet) {
+	flags.StringVar(&p.runtimeEndpoint, "runtimeEndpoint", "", fmt.Sprintf("Unix socket of the CRI runtime service, the first existing one of %v if empty.", defaultRuntimeEndpoints))
+	flags.DurationVar(&p.runtimeTimeout, "runtimeTimeout", 30*time.Second, "Timeout of the CRI runtime requests.")
+	flags.StringVar(&p.lxcfsHostRoot, "lxcfsHostRoot", defaultLxcfsHostRoot, "Host directory contains the LXCFS mount point, the same as the webhook.")
+	flags.StringVar(&p.lxcfsMountDir, "lxcfsMountDir", defaultLxcfsMountDir, "Sub directory of -lxcfsHostRoot where LXCFS is mounted, the same as the webhook.")
+	flags.StringVar(&p.lxcfsPodSelector, "lxcfsPodSelector", defaultLxcfsPodSelector, "Label selector of the LXCFS DaemonSet pods, which are skipped.")
+	flags.StringVar(&p.procRoot, "procRoot", "/proc", "Proc file system of the host PID namespace.")
+	flags.StringVar(&p.annotationPrefix, "annotationPrefix", defaultAnnotationPrefix, "Prefix of the pod annotations, the same as annotationPrefix in the config file of the webhook.")
+	flags.StringVar(&p.lockFile, "lockFile", defaultAgentLockFile, "Lock file serializing the agent processes on the node, in a host directory not mounted into the pods.")
+	flags.StringVar(&p.logFormat, "logFormat", logFormatText, fmt.Sprintf("Log format, one of %v.", []string{logFormatText, logFormatJSON}))
+	flags.StringVar(&p.logLevel, "logLevel", logLevelInfo.String(), fmt.Sprintf("Minimum level of the logs to write, one of %v.", logLevelNames))
+	flag.CommandLine.VisitAll(func(f *flag.Flag) { flags.Var(f.Value, f.Name, f.Usage) })
+}
+
+// parseSubcommandFlags parse the command line arguments after the subcommand and set up logging
+func (p *agentParameters) parseSubcommandFlags(flags *flag.FlagSet, args []string) error {
+	_ = flags.Parse(args)
+	// the klog flags are in the command line flag set, they are parsed by flags
+	_ = flag.CommandLine.Parse(nil)
+	return setupLogging(p.logFormat, p.logLevel)
+}
+
+// newAgent connect the CRI runtime service and create the agent, the connection should be closed after use
+func (p *agentParameters) newAgent() (*lxcfsAgent, *grpc.ClientConn, error) {
+	mount, err := newLxcfsMount(p.lxcfsHostRoot, p.lxcfsMountDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	lxcfsPods, err := labels.Parse(p.lxcfsPodSelector)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid LXCFS pod selector %q: %v", p.lxcfsPodSelector, err)
+	}
+	if errs := validation.IsDNS1123Subdomain(p.annotationPrefix); len(errs) > 0 {
+		return nil, nil, fmt.Errorf("invalid annotation prefix %q: %s", p.annotationPrefix, strings.Join(errs, ", "))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.runtimeTimeout)
+	defer cancel()
+	conn, err := dialRuntime(ctx, p.runtimeEndpoint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect CRI runtime: %v", err)
+	}
+
+	return &lxcfsAgent{
+		runtime:          runtimeapi.NewRuntimeServiceClient(conn),
+		mounter:          nsenterMounter{procRoot: p.procRoot},
+		mount:            mount,
+		lxcfsPods:        lxcfsPods,
+		pid:              os.Getpid(),
+		lockFile:         p.lockFile,
+		annotationPrefix: p.annotationPrefix,
+	}, conn, nil
+}
+
+// runAgent run the agent subcommand with the command line arguments after it
+func runAgent(args []string) error {
+	var parameters agentParameters
+	var action, nodeName, kubeconfig, cgroupRoot string
+	var waitMounted, interval time.Duration
+	var metricsPort int
+	var publishNodeFiles bool
+
+	flags := flag.NewFlagSet(agentCommand, flag.ExitOnError)
+	flags.StringVar(&action, "action", "", fmt.Sprintf("Adjust the LXCFS mounts in the containers of the mutated pods on the node, one of %v.", agentActions))
+	flags.DurationVar(&waitMounted, "waitMounted", 30*time.Second, "Time to wait for LXCFS mounted before remount.")
+	flags.DurationVar(&interval, "interval", 10*time.Second, "Interval of the watch action checking LXCFS and the containers.")
+	flags.StringVar(&nodeName, "nodeName", os.Getenv("NODE_NAME"), "Node name in the metrics of the watch action, the hostname if empty.")
+	flags.IntVar(&metricsPort, "metricsPort", 9102, "Port serves /metrics of the watch action, 0 to disable.")
+	flags.BoolVar(&publishNodeFiles, "publishNodeFiles", false, fmt.Sprintf("Publish the LXCFS files supported and the cgroup mode to the node annotations %s and %s by the watch action.", lxcfsFilesNodeAnnotation, cgroupModeNodeAnnotation))
+	flags.StringVar(&kubeconfig, "kubeconfig", "", "Path to kubeconfig for -publishNodeFiles, in-cluster config is used if empty.")
+	flags.StringVar(&cgroupRoot, "cgroupRoot", "/sys/fs/cgroup", "Cgroup root of the host, to detect the cgroup mode published.")
+	parameters.addFlags(flags)
+	if err := parameters.parseSubcommandFlags(flags, args); err != nil {
+		return err
+	}
+
+	if action != agentActionRemount && action != agentActionUmount && action != agentActionWatch {
+		return fmt.Errorf("invalid action %q, should be one of %v", action, agentActions)
+	}
+	agent, conn, err := parameters.newAgent()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if action == agentActionWatch {
+		if nodeName == "" {
+			if nodeName, err = os.Hostname(); err != nil {
+				return err
+			}
+		}
+		watchdog := &lxcfsWatchdog{agent: agent, node: nodeName}
+		if publishNodeFiles {
+			client, err := kubernetesClient(kubeconfig)
+			if err != nil {
+				return err
+			}
+			watchdog.publisher = &nodeFilesPublisher{client: client, node: nodeName, cgroupMode: cgroupMode(cgroupRoot)}
+		}
+		return runWatchdog(watchdog, interval, parameters.runtimeTimeout, metricsPort)
+	}
+
+	// the post-start hook runs immediately after the LXCFS container created, before LXCFS mounted
+	if action == agentActionRemount {
+		if err := wait.PollImmediate(time.Second, waitMounted, agent.lxcfsMounted); err != nil {
+			return fmt.Errorf("LXCFS not mounted at %s: %v", agent.source("/"), err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), parameters.runtimeTimeout)
+	defer cancel()
+	return agent.run(ctx, action)
+}
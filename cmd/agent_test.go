@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"gotest.tools/assert"
+	"k8s.io/apimachinery/pkg/labels"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+var (
+	cmpMountInfo      = cmp.AllowUnexported(mountInfo{})
+	cmpLxcfsContainer = cmp.AllowUnexported(lxcfsContainer{})
+)
+
+// fakeRuntimeService the CRI runtime service serves the pod sandboxes and containers given
+type fakeRuntimeService struct {
+	runtimeapi.UnimplementedRuntimeServiceServer
+	sandboxes  []*runtimeapi.PodSandbox
+	containers []*runtimeapi.Container
+	statuses   map[string]*runtimeapi.ContainerStatusResponse
+}
+
+func (s *fakeRuntimeService) ListPodSandbox(_ context.Context, req *runtimeapi.ListPodSandboxRequest) (*runtimeapi.ListPodSandboxResponse, error) {
+	resp := &runtimeapi.ListPodSandboxResponse{}
+	for _, sandbox := range s.sandboxes {
+		if state := req.GetFilter().GetState(); state != nil && state.State != sandbox.State {
+			continue
+		}
+		resp.Items = append(resp.Items, sandbox)
+	}
+	return resp, nil
+}
+
+func (s *fakeRuntimeService) ListContainers(_ context.Context, req *runtimeapi.ListContainersRequest) (*runtimeapi.ListContainersResponse, error) {
+	resp := &runtimeapi.ListContainersResponse{}
+	for _, container := range s.containers {
+		if id := req.GetFilter().GetPodSandboxId(); id != "" && id != container.PodSandboxId {
+			continue
+		}
+		if state := req.GetFilter().GetState(); state != nil && state.State != container.State {
+			continue
+		}
+		resp.Containers = append(resp.Containers, container)
+	}
+	return resp, nil
+}
+
+func (s *fakeRuntimeService) ContainerStatus(_ context.Context, req *runtimeapi.ContainerStatusRequest) (*runtimeapi.ContainerStatusResponse, error) {
+	if status, ok := s.statuses[req.ContainerId]; ok {
+		return status, nil
+	}
+	return nil, fmt.Errorf("container %s not found", req.ContainerId)
+}
+
+// add a running container of sandbox with the mounts in container, the pid is put in verbose info,
+// the LXCFS files are mounted from the subPath of the LXCFS volume like kubelet does
+func (s *fakeRuntimeService) addContainer(sandbox, name string, pid int, mounts ...string) {
+	id := sandbox + "-" + name
+	s.containers = append(s.containers, &runtimeapi.Container{
+		Id:           id,
+		PodSandboxId: sandbox,
+		Metadata:     &runtimeapi.ContainerMetadata{Name: name},
+		State:        runtimeapi.ContainerState_CONTAINER_RUNNING,
+	})
+	status := &runtimeapi.ContainerStatus{Id: id, Metadata: &runtimeapi.ContainerMetadata{Name: name}}
+	for i, m := range mounts {
+		hostPath := m
+		if strings.HasPrefix(m, "/proc/") || strings.HasPrefix(m, "/sys/") {
+			hostPath = fmt.Sprintf("/var/lib/kubelet/pods/%s/volume-subpaths/%s/%s/%d", sandbox, lxcfsVol, name, i)
+		}
+		status.Mounts = append(status.Mounts, &runtimeapi.Mount{ContainerPath: m, HostPath: hostPath})
+	}
+	s.statuses[id] = &runtimeapi.ContainerStatusResponse{
+		Status: status,
+		Info:   map[string]string{"info": fmt.Sprintf(`{"pid":%d}`, pid)},
+	}
+}
+
+// startFakeRuntimeService serve the fake CRI runtime service on a unix socket, return the client connected
+func startFakeRuntimeService(t *testing.T, service *fakeRuntimeService) runtimeapi.RuntimeServiceClient {
+	endpoint := filepath.Join(t.TempDir(), "cri.sock")
+	listener, err := net.Listen("unix", endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	runtimeapi.RegisterRuntimeServiceServer(server, service)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialRuntime(ctx, "unix://"+endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return runtimeapi.NewRuntimeServiceClient(conn)
+}
+
+// fakeMounter the mount tables of the processes, the LXCFS files are connected if lxcfsUp
+type fakeMounter struct {
+	mu         sync.Mutex
+	mountTable map[int][]mountInfo
+	stale      map[int]map[string]int // the number of LXCFS mounts lost FUSE connection, stacked on the top
+	lxcfsUp    bool
+	source     string
+}
+
+func (m *fakeMounter) mounts(pid int) ([]mountInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if table, ok := m.mountTable[pid]; ok {
+		return append([]mountInfo{}, table...), nil
+	}
+	return nil, fmt.Errorf("process %d not found", pid)
+}
+
+func (m *fakeMounter) connected(pid int, file string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if strings.HasPrefix(file, m.source) {
+		return m.lxcfsUp
+	}
+	return m.stale[pid][file] == 0
+}
+
+func (m *fakeMounter) unmount(pid int, target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table := m.mountTable[pid]
+	for i := len(table) - 1; i >= 0; i-- {
+		if table[i].mountPoint == target {
+			m.mountTable[pid] = append(table[:i:i], table[i+1:]...)
+			if m.stale[pid][target] > 0 {
+				m.stale[pid][target]--
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s not mounted", target)
+}
+
+func (m *fakeMounter) bindMount(pid int, source, target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !strings.HasPrefix(source, m.source) {
+		return fmt.Errorf("unexpected source %s", source)
+	}
+	m.mountTable[pid] = append(m.mountTable[pid], mountInfo{mountPoint: target, fsType: lxcfsFsType})
+	return nil
+}
+
+// lxcfsFilesMounted the LXCFS mount points in the mount table of pid
+func (m *fakeMounter) lxcfsFilesMounted(pid int) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	files := []string{}
+	for _, mount := range m.mountTable[pid] {
+		if mount.fsType == lxcfsFsType {
+			files = append(files, mount.mountPoint)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestParseMountInfo(t *testing.T) {
+	mountInfoExample := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+45 22 0:40 / /var/lib/lxc/lxcfs rw,nosuid,nodev,relatime shared:20 - fuse.lxcfs lxcfs rw,user_id=0,group_id=0,allow_other
+46 22 0:40 /proc/meminfo /proc/meminfo ro,nosuid,nodev,relatime master:20 - fuse.lxcfs lxcfs rw
+47 22 8:1 /data /mnt/with\040space rw,relatime - ext4 /dev/sda1 rw
+`
+	mounts, err := parseMountInfo(strings.NewReader(mountInfoExample))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, mounts, []mountInfo{
+		{mountPoint: "/", fsType: "ext4", root: "/"},
+		{mountPoint: "/var/lib/lxc/lxcfs", fsType: lxcfsFsType, root: "/"},
+		{mountPoint: "/proc/meminfo", fsType: lxcfsFsType, root: "/proc/meminfo"},
+		{mountPoint: "/mnt/with space", fsType: "ext4", root: "/data"},
+	}, cmpMountInfo)
+
+	_, err = parseMountInfo(strings.NewReader("22 1 8:1 / / rw\n"))
+	assert.Equal(t, err != nil, true)
+}
+
+func TestLxcfsAgent(t *testing.T) {
+	service := &fakeRuntimeService{
+		sandboxes: []*runtimeapi.PodSandbox{
+			{
+				Id:       "nginx",
+				Metadata: &runtimeapi.PodSandboxMetadata{Namespace: "demo", Name: "nginx"},
+				State:    runtimeapi.PodSandboxState_SANDBOX_READY,
+				Annotations: map[string]string{
+					admissionWebhookAnnotationStatusKey:            admissionWebhookSuccessFlag,
+					admissionWebhookAnnotationMutatedContainersKey: "nginx,sidecar,uptime",
+					admissionWebhookAnnotationMutatedFilesKey:      "/proc/cpuinfo,/proc/meminfo,/proc/uptime",
+				},
+			},
+			{
+				Id:       "redis",
+				Metadata: &runtimeapi.PodSandboxMetadata{Namespace: "demo", Name: "redis"},
+				State:    runtimeapi.PodSandboxState_SANDBOX_READY,
+			},
+			{
+				Id:          "lxcfs",
+				Metadata:    &runtimeapi.PodSandboxMetadata{Namespace: "lxcfs", Name: "lxcfs-ds-1"},
+				State:       runtimeapi.PodSandboxState_SANDBOX_READY,
+				Labels:      map[string]string{"app": "lxcfs-ds"},
+				Annotations: map[string]string{admissionWebhookAnnotationStatusKey: admissionWebhookSuccessFlag},
+			},
+		},
+		statuses: make(map[string]*runtimeapi.ContainerStatusResponse),
+	}
+	service.addContainer("nginx", "nginx", 100, "/var/lib/lxc/", "/proc/cpuinfo", "/proc/meminfo", "/etc/hosts")
+	service.addContainer("nginx", "sidecar", 101, "/etc/hosts")
+	// the ephemeral container gets the LXCFS files not covered by its own volumes from the agent
+	service.addContainer("nginx", "debugger", 102, "/var/lib/lxc/", "/proc/uptime")
+	service.statuses["nginx-debugger"].Status.Mounts[1].HostPath = "/var/lib/kubelet/pods/nginx/volumes/kubernetes.io~empty-dir/uptime"
+	service.addContainer("nginx", readinessGuardContainerName, 104, "/var/lib/lxc/")
+	// the uptime skipped for the conflicting volume of the container
+	service.addContainer("nginx", "uptime", 103, "/var/lib/lxc/")
+	service.statuses["nginx-uptime"].Status.Mounts = append(service.statuses["nginx-uptime"].Status.Mounts,
+		&runtimeapi.Mount{ContainerPath: "/proc/uptime", HostPath: "/var/lib/kubelet/pods/nginx/volumes/kubernetes.io~configmap/uptime"})
+	service.addContainer("redis", "redis", 200, "/var/lib/lxc/", "/proc/meminfo")
+	service.addContainer("lxcfs", "lxcfs", 300, "/var/lib/lxc/")
+
+	mount, err := newLxcfsMount(defaultLxcfsHostRoot, defaultLxcfsMountDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounter := &fakeMounter{
+		mountTable: map[int][]mountInfo{
+			// the meminfo mounted twice by the remounts before, both lost FUSE connection,
+			// and the cpuinfo mounted from the directory created by kubelet before LXCFS mounted
+			100: {
+				{"/proc/meminfo", "proc", "/"},
+				{"/proc/meminfo", lxcfsFsType, "/proc/meminfo"},
+				{"/proc/meminfo", lxcfsFsType, "/proc/meminfo"},
+				{"/proc/cpuinfo", "ext4", "/var/lib/lxc/lxcfs/proc/cpuinfo//deleted"},
+			},
+			102: {},
+			103: {},
+			104: {},
+			300: {{"/var/lib/lxc/lxcfs", lxcfsFsType, "/"}},
+		},
+		stale:  map[int]map[string]int{100: {"/proc/meminfo": 2}},
+		source: "/var/lib/lxc/lxcfs",
+	}
+	agent := &lxcfsAgent{
+		runtime:   startFakeRuntimeService(t, service),
+		mounter:   mounter,
+		mount:     mount,
+		lxcfsPods: labels.SelectorFromSet(labels.Set{"app": "lxcfs-ds"}),
+		pid:       300,
+	}
+	ctx := context.Background()
+
+	containers, err := lxcfsContainers(ctx, agent.runtime, agent.lxcfsPods, mount, agent.annotationPrefix)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, containers, []lxcfsContainer{
+		{id: "nginx-nginx", name: "nginx", podNamespace: "demo", podName: "nginx", pid: 100, files: []string{"/proc/cpuinfo", "/proc/meminfo"}},
+		{id: "nginx-debugger", name: "debugger", podNamespace: "demo", podName: "nginx", pid: 102, files: []string{"/proc/cpuinfo", "/proc/meminfo"}, ephemeral: true},
+	}, cmpLxcfsContainer)
+
+	stray, err := agent.strayFiles(containers[0])
+	assert.NilError(t, err)
+	assert.DeepEqual(t, stray, []string{"/proc/cpuinfo"})
+
+	// the files can't be remounted before LXCFS mounted
+	assert.Equal(t, agent.run(ctx, agentActionRemount) != nil, true)
+	assert.DeepEqual(t, mounter.lxcfsFilesMounted(100), []string{})
+
+	mounter.lxcfsUp = true
+	mounted, err := agent.lxcfsMounted()
+	assert.NilError(t, err)
+	assert.Equal(t, mounted, true)
+
+	testCases := []struct {
+		name   string
+		action string
+		except map[int][]string
+	}{
+		{"test remount", agentActionRemount, map[int][]string{
+			100: {"/proc/cpuinfo", "/proc/meminfo"},
+			102: {"/proc/cpuinfo", "/proc/meminfo"},
+			103: {},
+			104: {},
+		}},
+		{"test remount again", agentActionRemount, map[int][]string{
+			100: {"/proc/cpuinfo", "/proc/meminfo"},
+			102: {"/proc/cpuinfo", "/proc/meminfo"},
+		}},
+		{"test umount", agentActionUmount, map[int][]string{100: {}, 102: {}}},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+
+		assert.NilError(t, agent.run(ctx, testCase.action))
+		for pid, files := range testCase.except {
+			assert.DeepEqual(t, mounter.lxcfsFilesMounted(pid), files)
+		}
+	}
+	// the original proc file is not unmounted
+	assert.DeepEqual(t, mounter.mountTable[100], []mountInfo{{"/proc/meminfo", "proc", "/"}}, cmpMountInfo)
+	assert.Equal(t, agent.run(ctx, "unknown") != nil, true)
+}
+
+func TestLxcfsAgentLockMounts(t *testing.T) {
+	first := &lxcfsAgent{lockFile: filepath.Join(t.TempDir(), "agent.lock")}
+	second := &lxcfsAgent{lockFile: first.lockFile}
+
+	ctx := context.Background()
+	unlock, err := first.lockMounts(ctx)
+	assert.NilError(t, err)
+
+	// the lock held by others is retried until the deadline
+	timeout, cancel := context.WithTimeout(ctx, 3*agentLockRetryPeriod)
+	defer cancel()
+	_, err = second.lockMounts(timeout)
+	assert.Equal(t, err, context.DeadlineExceeded)
+
+	go func() {
+		time.Sleep(agentLockRetryPeriod)
+		unlock()
+	}()
+	timeout, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	unlock, err = second.lockMounts(timeout)
+	assert.NilError(t, err)
+	unlock()
+}
+
+func TestLxcfsContainersWithAnnotationPrefix(t *testing.T) {
+	service := &fakeRuntimeService{
+		sandboxes: []*runtimeapi.PodSandbox{{
+			Id:       "nginx",
+			Metadata: &runtimeapi.PodSandboxMetadata{Namespace: "demo", Name: "nginx"},
+			State:    runtimeapi.PodSandboxState_SANDBOX_READY,
+			Annotations: map[string]string{
+				"lxcfs.example.com/status":        admissionWebhookSuccessFlag,
+				"lxcfs.example.com/mutated-files": "/proc/meminfo",
+			},
+		}},
+		statuses: make(map[string]*runtimeapi.ContainerStatusResponse),
+	}
+	service.addContainer("nginx", "nginx", 100, "/var/lib/lxc/", "/proc/meminfo")
+	runtime := startFakeRuntimeService(t, service)
+
+	mount, err := newLxcfsMount(defaultLxcfsHostRoot, defaultLxcfsMountDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name       string
+		prefix     string
+		containers int
+	}{
+		{"test with default prefix", defaultAnnotationPrefix, 0},
+		{"test with configured prefix", "lxcfs.example.com", 1},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+		containers, err := lxcfsContainers(context.Background(), runtime, labels.Nothing(), mount, testCase.prefix)
+		assert.NilError(t, err)
+		assert.Equal(t, len(containers), testCase.containers)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// mutate the pods
+	policyModeEnforce = "enforce"
+	// only annotate the pods with what would be mutated, no volume is mounted
+	policyModeAudit = "audit"
+)
+
+var policyModes = []string{policyModeEnforce, policyModeAudit}
+
+// admission outcome of the requests handled in audit mode
+const outcomeAudit = "audit"
+
+// the annotation records what would be mutated in audit mode
+const admissionWebhookAnnotationAuditKey = "mutating.lxcfs-admission-webhook.io/audit"
+
+// auditRecord the decision of an admission request in audit mode, the value of audit annotation
+type auditRecord struct {
+	Status         string          `json:"status"`               // the status annotation would be set
+	Reason         string          `json:"reason,omitempty"`     // why the pod would be skipped
+	Policy         string          `json:"policy,omitempty"`     // the LxcfsPolicy applied
+	Containers     string          `json:"containers,omitempty"` // the containers would be mutated
+	Files          string          `json:"files,omitempty"`      // the LXCFS files would be mounted
+	Mounts         []auditMount    `json:"mounts,omitempty"`
+	NodeAffinity   bool            `json:"nodeAffinity,omitempty"`   // the node affinity to LXCFS ready nodes would be added
+	ReadinessGuard bool            `json:"readinessGuard,omitempty"` // the readiness guard init container would be added
+	Conflicts      json.RawMessage `json:"conflicts,omitempty"`
+}
+
+// auditMount a LXCFS volume mount would be added to or replace the container's
+type auditMount struct {
+	Container string `json:"container"`
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+	SubPath   string `json:"subPath,omitempty"`
+	Replaced  bool   `json:"replaced,omitempty"`
+}
+
+// validPolicyMode check whether the policy mode is supported
+func validPolicyMode(mode string) bool {
+	for _, m := range policyModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// auditRequired check whether the admission requests in namespace are handled in audit mode
+func (p *webhookPolicy) auditRequired(namespace string) bool {
+	if p.Mode == policyModeAudit {
+		return true
+	}
+	for _, ns := range p.AuditNamespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// auditAnnotations replace the annotations to patch by the audit annotation,
+// which records the decision and the volume mounts would be patched
+func auditAnnotations(annotations map[string]string, skipReason string, mounts []containerVolumeMounts, nodeAffinity, readinessGuard bool) map[string]string {
+	record := auditRecord{
+		NodeAffinity:   nodeAffinity,
+		ReadinessGuard: readinessGuard,
+		Status:         annotations[admissionWebhookAnnotationStatusKey],
+		Reason:         skipReason,
+		Policy:         annotations[admissionWebhookAnnotationPolicyKey],
+		Containers:     annotations[admissionWebhookAnnotationMutatedContainersKey],
+		Files:          annotations[admissionWebhookAnnotationMutatedFilesKey],
+	}
+	if conflicts := annotations[admissionWebhookAnnotationConflictsKey]; conflicts != "" {
+		record.Conflicts = json.RawMessage(conflicts)
+	}
+	for _, c := range mounts {
+		indexes := make([]int, 0, len(c.replaced))
+		for idx := range c.replaced {
+			indexes = append(indexes, idx)
+		}
+		sort.Ints(indexes)
+		for _, idx := range indexes {
+			record.Mounts = append(record.Mounts, newAuditMount(c.container, c.replaced[idx], true))
+		}
+		for _, vm := range c.added {
+			record.Mounts = append(record.Mounts, newAuditMount(c.container, vm, false))
+		}
+	}
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return nil
+	}
+	return map[string]string{admissionWebhookAnnotationAuditKey: string(value)}
+}
+
+func newAuditMount(container *corev1.Container, vm corev1.VolumeMount, replaced bool) auditMount {
+	return auditMount{
+		Container: container.Name,
+		Name:      vm.Name,
+		MountPath: vm.MountPath,
+		SubPath:   vm.SubPath,
+		Replaced:  replaced,
+	}
+}
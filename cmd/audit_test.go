@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestWebhookServerMutateInAuditMode(t *testing.T) {
+	whsvr := NewWebhookServer()
+
+	conflicting := GetAdmissionReviewExample()
+	var pod corev1.Pod
+	if err := json.Unmarshal(conflicting.Request.Object.Raw, &pod); err != nil {
+		t.Error(err)
+	}
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: lxcfsVol})
+	conflicting.Request.Object.Raw, _ = json.Marshal(pod)
+
+	testCases := []struct {
+		name     string
+		config   webhookConfig
+		conflict bool
+		audited  bool
+		decision string
+	}{
+		{"test with enforce mode", webhookConfig{}, false, false, admissionWebhookSuccessFlag},
+		{"test with audit mode", webhookConfig{Mode: policyModeAudit}, false, true, admissionWebhookSuccessFlag},
+		{"test with audit namespace", webhookConfig{AuditNamespaces: []string{"demo2"}}, false, true, admissionWebhookSuccessFlag},
+		{"test with other audit namespace", webhookConfig{AuditNamespaces: []string{"demo1"}}, false, false, admissionWebhookSuccessFlag},
+		{"test with conflict in audit mode", webhookConfig{Mode: policyModeAudit}, true, true, admissionWebhookConflictFlag},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+
+		policy, err := newWebhookPolicy(testCase.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		whsvr.setPolicy(policy)
+		ar := GetAdmissionReviewExample()
+		if testCase.conflict {
+			ar = conflicting
+		}
+		audits := testutil.ToFloat64(auditDecisions.WithLabelValues("demo2", testCase.decision))
+
+		admissionResponse := whsvr.mutate(ar)
+		assert.Equal(t, admissionResponse.Allowed, true)
+
+		var patches []patchOperation
+		if err := json.Unmarshal(admissionResponse.Patch, &patches); err != nil {
+			t.Fatal(err)
+		}
+		if !testCase.audited {
+			assert.Equal(t, len(patches) > 1, true)
+			assert.Equal(t, testutil.ToFloat64(auditDecisions.WithLabelValues("demo2", testCase.decision)), audits)
+			continue
+		}
+
+		// only the audit annotation is patched
+		assert.Equal(t, len(patches), 1)
+		assert.Equal(t, patches[0].Path, "/metadata/annotations")
+		annotations, _ := patches[0].Value.(map[string]interface{})
+		assert.Equal(t, len(annotations), 1)
+		var record auditRecord
+		value, _ := annotations[admissionWebhookAnnotationAuditKey].(string)
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, record.Status, testCase.decision)
+		assert.Equal(t, len(record.Mounts) > 0, !testCase.conflict)
+		assert.Equal(t, len(record.Conflicts) > 0, testCase.conflict)
+		assert.Equal(t, testutil.ToFloat64(auditDecisions.WithLabelValues("demo2", testCase.decision)), audits+1)
+	}
+}
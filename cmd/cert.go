@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// interval to check whether the certificate files changed
+var certReloadInterval = 10 * time.Second
+
+// certificateProvider provide the serving certificate for tls.Config and keep it up to date
+type certificateProvider interface {
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	watch(stopCh <-chan struct{}) // update the certificate until stopCh closed
+}
+
+// keyPairReloader serve the x509 key pair loaded from files, reload it when the files changed
+type keyPairReloader struct {
+	certFile string
+	keyFile  string
+	keyPair  atomic.Value // *tls.Certificate in use
+
+	// content of the files last loaded, to check whether the files changed
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newKeyPairReloader create keyPairReloader, the key pair files must be valid
+func newKeyPairReloader(certFile, keyFile string) (*keyPairReloader, error) {
+	reloader := &keyPairReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// loadKeyPair parse the PEM encoded key pair and its leaf certificate
+func loadKeyPair(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &pair, nil
+}
+
+// reload load the key pair if the files changed, return whether the key pair in use replaced,
+// the key pair in use is kept if the files are invalid
+func (r *keyPairReloader) reload() (bool, error) {
+	certPEM, err := os.ReadFile(r.certFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read certificate file: %v", err)
+	}
+	keyPEM, err := os.ReadFile(r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read private key file: %v", err)
+	}
+	if bytes.Equal(certPEM, r.certPEM) && bytes.Equal(keyPEM, r.keyPEM) {
+		return false, nil
+	}
+
+	pair, err := loadKeyPair(certPEM, keyPEM)
+	// the files may be invalid until both of them updated, retry when changed again
+	r.certPEM, r.keyPEM = certPEM, keyPEM
+	if err != nil {
+		return false, fmt.Errorf("failed to load key pair %s, %s: %v", r.certFile, r.keyFile, err)
+	}
+	r.keyPair.Store(pair)
+	recordCertificate(pair.Leaf)
+	return true, nil
+}
+
+// GetCertificate get the key pair in use, for tls.Config
+func (r *keyPairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.keyPair.Load().(*tls.Certificate), nil
+}
+
+// watch reload the key pair files until stopCh closed
+func (r *keyPairReloader) watch(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := r.reload()
+		if err != nil {
+			defaultLogger.error("Failed to reload key pair, keep serving the previous certificate", "error", err)
+			continue
+		}
+		if reloaded {
+			leaf := r.keyPair.Load().(*tls.Certificate).Leaf
+			defaultLogger.info("Reloaded key pair", "certFile", r.certFile, "keyFile", r.keyFile, "notAfter", leaf.NotAfter)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// writeKeyPairFiles write a self-signed key pair with the common name to files
+func writeKeyPairFiles(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyPairReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	_, err := newKeyPairReloader(certFile, keyFile)
+	assert.Equal(t, err != nil, true)
+
+	writeKeyPairFiles(t, certFile, keyFile, "first")
+	reloader, err := newKeyPairReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		pair, _ := reloader.GetCertificate(&tls.ClientHelloInfo{})
+		return pair.Leaf.Subject.CommonName
+	}
+	assert.Equal(t, commonName(), "first")
+
+	reloaded, err := reloader.reload()
+	assert.NilError(t, err)
+	assert.Equal(t, reloaded, false)
+
+	writeKeyPairFiles(t, certFile, keyFile, "second")
+	reloaded, err = reloader.reload()
+	assert.NilError(t, err)
+	assert.Equal(t, reloaded, true)
+	assert.Equal(t, commonName(), "second")
+
+	// keep serving the previous certificate if the new key pair is invalid
+	if err := os.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err = reloader.reload()
+	assert.Equal(t, err != nil, true)
+	assert.Equal(t, reloaded, false)
+	assert.Equal(t, commonName(), "second")
+
+	writeKeyPairFiles(t, certFile, keyFile, "third")
+	reloaded, err = reloader.reload()
+	assert.NilError(t, err)
+	assert.Equal(t, reloaded, true)
+	assert.Equal(t, commonName(), "third")
+}
+
+func TestStartWebhookServerWithInvalidKeyPair(t *testing.T) {
+	dir := t.TempDir()
+	parameters := WhSvrParameters{
+		port:     8443,
+		certFile: filepath.Join(dir, "tls.crt"),
+		keyFile:  filepath.Join(dir, "tls.key"),
+	}
+
+	whsvr, err := startWebhookServer(&parameters)
+	assert.Equal(t, err != nil, true)
+	assert.Equal(t, whsvr == nil, true)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+)
+
+// the keys of the self-managed certificate secret
+const (
+	secretCACertKey       = "ca.crt"
+	secretCAKeyKey        = "ca.key"
+	secretCABundleKey     = "ca-bundle.crt" // the current CA, the staged CA and the previous CAs not expired yet
+	secretNextCACertKey   = "ca-next.crt"   // the CA staged in the bundle, signs the serving certificate after caStagingPeriod
+	secretNextCAKeyKey    = "ca-next.key"
+	secretNextCAStagedKey = "ca-next.staged" // the time the CA staged in RFC3339
+	secretTLSCertKey      = corev1.TLSCertKey
+	secretTLSKeyKey       = corev1.TLSPrivateKeyKey
+)
+
+var (
+	caValidity              = 10 * 365 * 24 * time.Hour
+	servingCertValidity     = 365 * 24 * time.Hour
+	servingCertRotateBefore = 30 * 24 * time.Hour // rotate serving certificate when it expires in this duration
+	certCheckInterval       = time.Minute
+	// the staged CA is published in caBundle for this duration before signing the serving certificate,
+	// so all the apiservers trust it and all the webhook replicas patched caBundle before the switch
+	caStagingPeriod = time.Hour
+)
+
+// certManager generate the CA and serving certificate stored in secret,
+// patch the caBundle of the MutatingWebhookConfiguration and rotate them before expired
+type certManager struct {
+	client            kubernetes.Interface
+	namespace         string // namespace of the webhook service and the secret
+	secretName        string
+	serviceName       string
+	webhookConfigName string       // name of the MutatingWebhookConfiguration to patch caBundle
+	keyPair           atomic.Value // *tls.Certificate in use
+}
+
+// kubernetesConfig load the client config from the kubeconfig file, in-cluster config is used if kubeconfig is empty
+func kubernetesConfig(kubeconfig string) (*rest.Config, error) {
+	return clientcmd.BuildConfigFromFlags("", kubeconfig)
+}
+
+// kubernetesClient create kubernetes client from the kubeconfig file, in-cluster config is used if kubeconfig is empty
+func kubernetesClient(kubeconfig string) (kubernetes.Interface, error) {
+	config, err := kubernetesConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// newCertManager create certManager and bootstrap the certificate
+func newCertManager(client kubernetes.Interface, namespace, secretName, serviceName, webhookConfigName string) (*certManager, error) {
+	m := &certManager{
+		client:            client,
+		namespace:         namespace,
+		secretName:        secretName,
+		serviceName:       serviceName,
+		webhookConfigName: webhookConfigName,
+	}
+	if err := m.reconcile(context.Background()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// dnsNames the DNS names of the webhook service the serving certificate valid for
+func (m *certManager) dnsNames() []string {
+	return []string{
+		m.serviceName,
+		fmt.Sprintf("%s.%s", m.serviceName, m.namespace),
+		fmt.Sprintf("%s.%s.svc", m.serviceName, m.namespace),
+		fmt.Sprintf("%s.%s.svc.cluster", m.serviceName, m.namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", m.serviceName, m.namespace),
+	}
+}
+
+// reconcile create or rotate the certificate in secret, patch caBundle and serve the certificate in secret
+func (m *certManager) reconcile(ctx context.Context) error {
+	var secret *corev1.Secret
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() (err error) {
+		secret, err = m.ensureSecret(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to ensure certificate secret %s/%s: %v", m.namespace, m.secretName, err)
+	}
+
+	// publish the CA before serving the certificate signed by it
+	if err := m.patchCABundle(ctx, secret.Data[secretCABundleKey]); err != nil {
+		return fmt.Errorf("failed to patch caBundle of %s: %v", m.webhookConfigName, err)
+	}
+
+	pair, err := loadKeyPair(secret.Data[secretTLSCertKey], secret.Data[secretTLSKeyKey])
+	if err != nil {
+		return fmt.Errorf("failed to load key pair from secret %s/%s: %v", m.namespace, m.secretName, err)
+	}
+	if old, ok := m.keyPair.Load().(*tls.Certificate); !ok || !bytes.Equal(old.Certificate[0], pair.Certificate[0]) {
+		defaultLogger.info("Serving certificate from secret", "namespace", m.namespace, "secret", m.secretName, "notAfter", pair.Leaf.NotAfter)
+	}
+	m.keyPair.Store(pair)
+	recordCertificate(pair.Leaf)
+	return nil
+}
+
+// ensureSecret create the secret or rotate the certificate in it if required
+func (m *certManager) ensureSecret(ctx context.Context) (*corev1.Secret, error) {
+	secret, err := m.client.CoreV1().Secrets(m.namespace).Get(ctx, m.secretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		data, _, err := rotateCertificates(nil, m.dnsNames(), time.Now())
+		if err != nil {
+			return nil, err
+		}
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: m.secretName, Namespace: m.namespace},
+			Type:       corev1.SecretTypeOpaque,
+			Data:       data,
+		}
+		created, err := m.client.CoreV1().Secrets(m.namespace).Create(ctx, secret, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			// created by other webhook replica, retry with it
+			return nil, apierrors.NewConflict(corev1.Resource("secrets"), m.secretName, err)
+		}
+		if err == nil {
+			defaultLogger.info("Created certificate secret", "namespace", m.namespace, "secret", m.secretName)
+		}
+		return created, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, rotated, err := rotateCertificates(secret.Data, m.dnsNames(), time.Now())
+	if err != nil || !rotated {
+		return secret, err
+	}
+	secret = secret.DeepCopy()
+	secret.Data = data
+	updated, err := m.client.CoreV1().Secrets(m.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	if err == nil {
+		defaultLogger.info("Rotated certificate in secret", "namespace", m.namespace, "secret", m.secretName)
+	}
+	return updated, err
+}
+
+// patchCABundle set the caBundle of all the webhooks in MutatingWebhookConfiguration,
+// the MutatingWebhookConfiguration may be not created yet, patch it in next reconcile
+func (m *certManager) patchCABundle(ctx context.Context, caBundle []byte) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		webhookConfigs := m.client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+		config, err := webhookConfigs.Get(ctx, m.webhookConfigName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			defaultLogger.warning("MutatingWebhookConfiguration not found, patch caBundle later", "webhookConfig", m.webhookConfigName)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		changed := false
+		config = config.DeepCopy()
+		for idx := range config.Webhooks {
+			if !bytes.Equal(config.Webhooks[idx].ClientConfig.CABundle, caBundle) {
+				config.Webhooks[idx].ClientConfig.CABundle = caBundle
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		if _, err := webhookConfigs.Update(ctx, config, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		defaultLogger.info("Patched caBundle of MutatingWebhookConfiguration", "webhookConfig", m.webhookConfigName)
+		return nil
+	})
+}
+
+// GetCertificate get the serving certificate in use, for tls.Config
+func (m *certManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.keyPair.Load().(*tls.Certificate), nil
+}
+
+// watch reconcile the certificate periodically until stopCh closed
+func (m *certManager) watch(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		if err := m.reconcile(context.Background()); err != nil {
+			defaultLogger.error("Failed to reconcile certificate, keep serving the previous certificate", "error", err)
+		}
+	}
+}
+
+// rotateCertificates generate the CA and serving certificate if they are missing, invalid or going to expire,
+// return the new secret data and whether rotated. The CA going to expire is rotated in two steps: the new CA is
+// staged in the bundle first, and the serving certificate is signed by it after caStagingPeriod.
+// The CA is replaced at once only if it's missing or expired, as no client trusts the serving certificate then.
+func rotateCertificates(data map[string][]byte, dnsNames []string, now time.Time) (map[string][]byte, bool, error) {
+	caCert, caKey, err := parseCA(data[secretCACertKey], data[secretCAKeyKey])
+	rotateCA := err != nil || now.After(caCert.NotAfter)
+
+	nextCert, nextKey, nextErr := parseCA(data[secretNextCACertKey], data[secretNextCAKeyKey])
+	stagedAt, stagedErr := time.Parse(time.RFC3339, string(data[secretNextCAStagedKey]))
+	staged := nextErr == nil && stagedErr == nil && now.Before(nextCert.NotAfter)
+
+	stageCA, promoteCA := false, false
+	switch {
+	case rotateCA:
+		promoteCA = staged
+	case caCert.NotAfter.Sub(now) < servingCertValidity:
+		stageCA = !staged
+		promoteCA = staged && now.Sub(stagedAt) >= caStagingPeriod
+	}
+
+	rotateServing := rotateCA || promoteCA
+	if !rotateServing {
+		pair, err := loadKeyPair(data[secretTLSCertKey], data[secretTLSKeyKey])
+		rotateServing = err != nil ||
+			pair.Leaf.NotAfter.Sub(now) < servingCertRotateBefore ||
+			pair.Leaf.CheckSignatureFrom(caCert) != nil
+	}
+	if !rotateServing && !stageCA {
+		return data, false, nil
+	}
+
+	rotated := make(map[string][]byte, len(data))
+	for key, value := range data {
+		rotated[key] = value
+	}
+
+	switch {
+	case promoteCA:
+		caCert, caKey = nextCert, nextKey
+		rotated[secretCACertKey], rotated[secretCAKeyKey] = data[secretNextCACertKey], data[secretNextCAKeyKey]
+		delete(rotated, secretNextCACertKey)
+		delete(rotated, secretNextCAKeyKey)
+		delete(rotated, secretNextCAStagedKey)
+	case rotateCA, stageCA:
+		caCertPEM, caKeyPEM, err := newCACertificate(now)
+		if err != nil {
+			return nil, false, err
+		}
+		if stageCA {
+			rotated[secretNextCACertKey], rotated[secretNextCAKeyKey] = caCertPEM, caKeyPEM
+			rotated[secretNextCAStagedKey] = []byte(now.UTC().Format(time.RFC3339))
+			break
+		}
+		if caCert, caKey, err = parseCA(caCertPEM, caKeyPEM); err != nil {
+			return nil, false, err
+		}
+		rotated[secretCACertKey], rotated[secretCAKeyKey] = caCertPEM, caKeyPEM
+	}
+	rotated[secretCABundleKey] = caBundle(now, rotated[secretCACertKey], rotated[secretNextCACertKey], data[secretCABundleKey])
+
+	if rotateServing {
+		certPEM, keyPEM, err := newServingCertificate(caCert, caKey, dnsNames, now)
+		if err != nil {
+			return nil, false, err
+		}
+		rotated[secretTLSCertKey], rotated[secretTLSKeyKey] = certPEM, keyPEM
+	}
+	return rotated, true, nil
+}
+
+// caBundle concatenate the PEM encoded CA certificates not expired, the duplicated are removed
+func caBundle(now time.Time, caPEMs ...[]byte) []byte {
+	var bundle []byte
+	seen := make(map[string]bool)
+	for _, caPEM := range caPEMs {
+		for {
+			var block *pem.Block
+			if block, caPEM = pem.Decode(caPEM); block == nil {
+				break
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil || now.After(cert.NotAfter) || seen[string(block.Bytes)] {
+				continue
+			}
+			seen[string(block.Bytes)] = true
+			bundle = append(bundle, pem.EncodeToMemory(block)...)
+		}
+	}
+	return bundle
+}
+
+// parseCA parse the PEM encoded CA certificate and private key
+func parseCA(certPEM, keyPEM []byte) (*x509.Certificate, crypto.Signer, error) {
+	pair, err := loadKeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !pair.Leaf.IsCA {
+		return nil, nil, fmt.Errorf("certificate %s is not a CA", pair.Leaf.Subject)
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("private key of CA %s is not a signer", pair.Leaf.Subject)
+	}
+	return pair.Leaf, signer, nil
+}
+
+// newCACertificate generate self-signed CA certificate, return the PEM encoded certificate and private key
+func newCACertificate(now time.Time) ([]byte, []byte, error) {
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("lxcfs-admission-webhook-ca@%d", now.Unix())},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return newCertificate(template, nil, nil)
+}
+
+// newServingCertificate generate serving certificate signed by CA, return the PEM encoded certificate and private key
+func newServingCertificate(caCert *x509.Certificate, caKey crypto.Signer, dnsNames []string, now time.Time) ([]byte, []byte, error) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: dnsNames[len(dnsNames)-1]},
+		DNSNames:    dnsNames,
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(servingCertValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	return newCertificate(template, caCert, caKey)
+}
+
+// newCertificate generate private key and certificate signed by parent, self-signed if parent is nil
+func newCertificate(template, parent *x509.Certificate, parentKey crypto.Signer) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128)); err != nil {
+		return nil, nil, err
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// countCertificates count the certificates in PEM encoded bundle
+func countCertificates(bundle []byte) (count int) {
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		count++
+	}
+	return count
+}
+
+func TestCertManager(t *testing.T) {
+	client := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "lxcfs-admission-webhook"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{Name: "mutating.lxcfs-admission-webhook.io"},
+			{Name: "mutating-workloads.lxcfs-admission-webhook.io"},
+		},
+	})
+
+	m, err := newCertManager(client, "lxcfs", "lxcfs-admission-webhook-cert", "lxcfs-admission-webhook", "lxcfs-admission-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	secret, err := client.CoreV1().Secrets("lxcfs").Get(ctx, "lxcfs-admission-webhook-cert", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{secretCACertKey, secretCAKeyKey, secretCABundleKey, secretTLSCertKey, secretTLSKeyKey} {
+		assert.Equal(t, len(secret.Data[key]) > 0, true, "secret data %s is empty", key)
+	}
+
+	config, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "lxcfs-admission-webhook", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, webhook := range config.Webhooks {
+		assert.DeepEqual(t, webhook.ClientConfig.CABundle, secret.Data[secretCABundleKey])
+	}
+
+	// the serving certificate is trusted by the caBundle for the service DNS name
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(secret.Data[secretCABundleKey])
+	pair, _ := m.GetCertificate(&tls.ClientHelloInfo{})
+	_, err = pair.Leaf.Verify(x509.VerifyOptions{DNSName: "lxcfs-admission-webhook.lxcfs.svc", Roots: roots})
+	assert.NilError(t, err)
+
+	// nothing updated if the certificate is not going to expire
+	client.ClearActions()
+	assert.NilError(t, m.reconcile(ctx))
+	for _, action := range client.Actions() {
+		assert.Equal(t, action.GetVerb(), "get")
+	}
+}
+
+func TestCertManagerWithoutWebhookConfig(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	_, err := newCertManager(client, "lxcfs", "lxcfs-admission-webhook-cert", "lxcfs-admission-webhook", "lxcfs-admission-webhook")
+	assert.NilError(t, err)
+}
+
+func TestRotateCertificates(t *testing.T) {
+	dnsNames := []string{"lxcfs-admission-webhook.lxcfs.svc"}
+	now := time.Now()
+
+	data, rotated, err := rotateCertificates(nil, dnsNames, now)
+	assert.NilError(t, err)
+	assert.Equal(t, rotated, true)
+	assert.Equal(t, countCertificates(data[secretCABundleKey]), 1)
+
+	testCases := []struct {
+		name          string
+		now           time.Time
+		rotated       bool
+		servingRotate bool
+		caStaged      bool
+	}{
+		{"test with valid certificate", now.Add(servingCertValidity - servingCertRotateBefore - time.Hour), false, false, false},
+		{"test with serving certificate going to expire", now.Add(servingCertValidity - servingCertRotateBefore + time.Hour), true, true, false},
+		{"test with CA going to expire", now.Add(caValidity - servingCertValidity + time.Hour), true, true, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+
+		got, rotated, err := rotateCertificates(data, dnsNames, testCase.now)
+		assert.NilError(t, err)
+		assert.Equal(t, rotated, testCase.rotated)
+		assert.Equal(t, bytes.Equal(got[secretTLSCertKey], data[secretTLSCertKey]), !testCase.servingRotate)
+		// the CA in use is not changed until the staged CA is trusted
+		assert.DeepEqual(t, got[secretCACertKey], data[secretCACertKey])
+		assert.Equal(t, len(got[secretNextCACertKey]) > 0, testCase.caStaged)
+		if testCase.caStaged {
+			// the new CA is published with the old one
+			assert.Equal(t, countCertificates(got[secretCABundleKey]), 2)
+		} else {
+			assert.DeepEqual(t, got[secretCABundleKey], data[secretCABundleKey])
+		}
+	}
+
+	// the serving certificate is signed by the staged CA after the staging period
+	stagedAt := now.Add(caValidity - servingCertValidity + time.Hour)
+	fresh, _, err := rotateCertificates(data, dnsNames, stagedAt.Add(-2*time.Hour))
+	assert.NilError(t, err)
+	staged, rotated, err := rotateCertificates(fresh, dnsNames, stagedAt)
+	assert.NilError(t, err)
+	assert.Equal(t, rotated, true)
+	assert.DeepEqual(t, staged[secretTLSCertKey], fresh[secretTLSCertKey])
+	got, rotated, err := rotateCertificates(staged, dnsNames, stagedAt.Add(caStagingPeriod/2))
+	assert.NilError(t, err)
+	assert.Equal(t, rotated, false)
+	assert.DeepEqual(t, got, staged)
+
+	got, rotated, err = rotateCertificates(staged, dnsNames, stagedAt.Add(caStagingPeriod))
+	assert.NilError(t, err)
+	assert.Equal(t, rotated, true)
+	assert.DeepEqual(t, got[secretCACertKey], staged[secretNextCACertKey])
+	assert.Equal(t, len(got[secretNextCACertKey]), 0)
+	assert.Equal(t, countCertificates(got[secretCABundleKey]), 2)
+	pair, err := loadKeyPair(got[secretTLSCertKey], got[secretTLSKeyKey])
+	assert.NilError(t, err)
+	caCert, _, err := parseCA(got[secretCACertKey], got[secretCAKeyKey])
+	assert.NilError(t, err)
+	assert.NilError(t, pair.Leaf.CheckSignatureFrom(caCert))
+
+	// the expired CA is replaced at once
+	got, rotated, err = rotateCertificates(data, dnsNames, now.Add(caValidity+time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, rotated, true)
+	assert.Equal(t, bytes.Equal(got[secretCACertKey], data[secretCACertKey]), false)
+	assert.Equal(t, countCertificates(got[secretCABundleKey]), 1)
+
+	// the expired CA is removed from the bundle
+	assert.Equal(t, countCertificates(caBundle(now.Add(caValidity+time.Hour), data[secretCABundleKey])), 0)
+}
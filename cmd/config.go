@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/version"
+	"sigs.k8s.io/yaml"
+)
+
+// the prefix of all annotation keys, see admissionWebhookAnnotationEnableKey
+const defaultAnnotationPrefix = "mutating.lxcfs-admission-webhook.io"
+
+// interval to check whether the config file changed
+var configReloadInterval = 10 * time.Second
+
+// webhookConfig the webhook policy, loaded from command line parameters and the config file,
+// the fields not set use the default value
+type webhookConfig struct {
+	Mode               string                    `json:"mode,omitempty"`
+	AuditNamespaces    []string                  `json:"auditNamespaces,omitempty"` // namespaces in audit mode even if mode is enforce
+	IgnoredNamespaces  []string                  `json:"ignoredNamespaces,omitempty"`
+	AnnotationPrefix   string                    `json:"annotationPrefix,omitempty"`
+	MutatingKinds      []metav1.GroupVersionKind `json:"mutatingKinds,omitempty"`
+	MutatingOperations []admissionv1.Operation   `json:"mutatingOperations,omitempty"`
+	ConflictStrategy   string                    `json:"conflictStrategy,omitempty"`
+	MutateWorkloads    bool                      `json:"mutateWorkloads,omitempty"`
+	NodeAffinity       bool                      `json:"nodeAffinity,omitempty"` // schedule the mutated pods to the nodes labeled LXCFS ready
+	LxcfsVersion       string                    `json:"lxcfsVersion,omitempty"`
+	LxcfsHostRoot      string                    `json:"lxcfsHostRoot,omitempty"`
+	LxcfsMountDir      string                    `json:"lxcfsMountDir,omitempty"`
+	Profiles           map[string][]string       `json:"profiles,omitempty"` // LXCFS profiles add to or override the builtin
+	ReadinessGuard     readinessGuardConfig      `json:"readinessGuard,omitempty"`
+}
+
+// webhookPolicy the validated webhookConfig used to handle admission requests, never modified after created
+type webhookPolicy struct {
+	webhookConfig
+	lxcfsVersion   *version.Version
+	lxcfs          *lxcfsMount
+	profiles       map[string][]string
+	readinessGuard *corev1.Container // prepended to the init containers of the mutated pods, nil if disabled
+}
+
+// default policy used if no policy loaded
+var defaultPolicy, _ = newWebhookPolicy(webhookConfig{})
+
+// newWebhookPolicy validate the config, fill the default value and create policy
+func newWebhookPolicy(config webhookConfig) (*webhookPolicy, error) {
+	if config.Mode == "" {
+		config.Mode = policyModeEnforce
+	}
+	if config.IgnoredNamespaces == nil {
+		config.IgnoredNamespaces = ignoredNamespaces
+	}
+	if config.AnnotationPrefix == "" {
+		config.AnnotationPrefix = defaultAnnotationPrefix
+	}
+	if config.MutatingKinds == nil {
+		config.MutatingKinds = validMutatingKindList
+	}
+	if config.MutatingOperations == nil {
+		config.MutatingOperations = validMutatingOperationList
+	}
+	if config.ConflictStrategy == "" {
+		config.ConflictStrategy = conflictStrategySkipPod
+	}
+	if config.LxcfsVersion == "" {
+		config.LxcfsVersion = defaultLxcfsVersion
+	}
+	if config.LxcfsHostRoot == "" {
+		config.LxcfsHostRoot = defaultLxcfsHostRoot
+	}
+	if config.LxcfsMountDir == "" {
+		config.LxcfsMountDir = defaultLxcfsMountDir
+	}
+
+	if !validPolicyMode(config.Mode) {
+		return nil, fmt.Errorf("invalid mode %q, must be one of %v", config.Mode, policyModes)
+	}
+	if errs := validation.IsDNS1123Subdomain(config.AnnotationPrefix); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid annotation prefix %q: %s", config.AnnotationPrefix, strings.Join(errs, ", "))
+	}
+	for _, operation := range config.MutatingOperations {
+		switch operation {
+		case admissionv1.Create, admissionv1.Update, admissionv1.Delete, admissionv1.Connect:
+		default:
+			return nil, fmt.Errorf("invalid mutating operation %q", operation)
+		}
+	}
+	if !validConflictStrategy(config.ConflictStrategy) {
+		return nil, fmt.Errorf("invalid conflict strategy %q, must be one of %v", config.ConflictStrategy, conflictStrategies)
+	}
+
+	lxcfsVersion, err := version.ParseGeneric(config.LxcfsVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LXCFS version: %v", err)
+	}
+	lxcfs, err := newLxcfsMount(config.LxcfsHostRoot, config.LxcfsMountDir)
+	if err != nil {
+		return nil, err
+	}
+	readinessGuard, err := lxcfs.readinessGuard(config.ReadinessGuard)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := make(map[string][]string, len(lxcfsProfiles)+len(config.Profiles))
+	for name, files := range lxcfsProfiles {
+		profiles[name] = files
+	}
+	for name, files := range config.Profiles {
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no LXCFS file in profile %q", name)
+		}
+		for _, file := range files {
+			if !lxcfsFileSupported(file, lxcfsVersion) {
+				return nil, fmt.Errorf("unsupported LXCFS file %q in profile %q by LXCFS version %v", file, name, lxcfsVersion)
+			}
+		}
+		if file, parent, found := nestedLxcfsFile(files); found {
+			return nil, fmt.Errorf("LXCFS file %q is under %q in profile %q, only one of them can be mounted", file, parent, name)
+		}
+		profiles[strings.ToLower(name)] = files
+	}
+
+	return &webhookPolicy{
+		webhookConfig:  config,
+		lxcfsVersion:   lxcfsVersion,
+		lxcfs:          lxcfs,
+		profiles:       profiles,
+		readinessGuard: readinessGuard,
+	}, nil
+}
+
+// annotationKey get the annotation key with the configured prefix of the default annotation key
+func (p *webhookPolicy) annotationKey(key string) string {
+	return p.AnnotationPrefix + strings.TrimPrefix(key, defaultAnnotationPrefix)
+}
+
+// importAnnotations convert the annotation keys with configured prefix to the default keys,
+// the annotations with default prefix are ignored if the prefix is configured
+func (p *webhookPolicy) importAnnotations(annotations map[string]string) map[string]string {
+	return importAnnotations(p.AnnotationPrefix, annotations)
+}
+
+// importAnnotations convert the annotation keys with prefix to the default keys, the annotations with default prefix
+// are ignored if the prefix is not the default, used by the node agent reading the annotations of the pod sandboxes
+func importAnnotations(prefix string, annotations map[string]string) map[string]string {
+	if prefix == "" || prefix == defaultAnnotationPrefix || annotations == nil {
+		return annotations
+	}
+
+	imported := make(map[string]string, len(annotations))
+	for key, value := range annotations {
+		if strings.HasPrefix(key, defaultAnnotationPrefix+"/") {
+			continue
+		}
+		if strings.HasPrefix(key, prefix+"/") {
+			key = defaultAnnotationPrefix + strings.TrimPrefix(key, prefix)
+		}
+		imported[key] = value
+	}
+	return imported
+}
+
+// exportAnnotations convert the default annotation keys to the keys with configured prefix
+func (p *webhookPolicy) exportAnnotations(annotations map[string]string) map[string]string {
+	exported := make(map[string]string, len(annotations))
+	for key, value := range annotations {
+		exported[p.annotationKey(key)] = value
+	}
+	return exported
+}
+
+// defaultConfig the config set by command line parameters, config file override it
+func (parameters *WhSvrParameters) defaultConfig() webhookConfig {
+	return webhookConfig{
+		Mode:             parameters.mode,
+		ConflictStrategy: parameters.conflictStrategy,
+		MutateWorkloads:  parameters.mutateWorkloads,
+		NodeAffinity:     parameters.nodeAffinity,
+		LxcfsVersion:     parameters.lxcfsVersion,
+		LxcfsHostRoot:    parameters.lxcfsHostRoot,
+		LxcfsMountDir:    parameters.lxcfsMountDir,
+		ReadinessGuard: readinessGuardConfig{
+			Enabled:       parameters.readinessGuard,
+			Image:         parameters.readinessGuardImage,
+			Timeout:       metav1.Duration{Duration: parameters.readinessGuardTimeout},
+			FailurePolicy: parameters.readinessGuardFailurePolicy,
+		},
+	}
+}
+
+// loadWebhookPolicy load the policy from command line parameters and the config file
+func loadWebhookPolicy(parameters *WhSvrParameters) (*webhookPolicy, []byte, error) {
+	config := parameters.defaultConfig()
+	if parameters.configFile == "" {
+		policy, err := newWebhookPolicy(config)
+		return policy, nil, err
+	}
+
+	content, err := os.ReadFile(parameters.configFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	policy, err := parseWebhookPolicy(parameters, content)
+	return policy, content, err
+}
+
+// parseWebhookPolicy create the policy from command line parameters and the content of the config file
+func parseWebhookPolicy(parameters *WhSvrParameters, content []byte) (*webhookPolicy, error) {
+	config := parameters.defaultConfig()
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", parameters.configFile, err)
+	}
+	policy, err := newWebhookPolicy(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", parameters.configFile, err)
+	}
+	return policy, nil
+}
+
+// currentPolicy get the policy in use, handle an admission request with the same policy
+func (whsvr *WebhookServer) currentPolicy() *webhookPolicy {
+	if policy, ok := whsvr.policy.Load().(*webhookPolicy); ok {
+		return policy
+	}
+	return defaultPolicy
+}
+
+// setPolicy replace the policy in use atomically
+func (whsvr *WebhookServer) setPolicy(policy *webhookPolicy) {
+	whsvr.policy.Store(policy)
+}
+
+// watchConfig reload the config file when it changed or got SIGHUP signal,
+// keep the last good policy if the config file is invalid
+func (whsvr *WebhookServer) watchConfig(parameters *WhSvrParameters, loaded []byte, stopCh <-chan struct{}) {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+
+	ticker := time.NewTicker(configReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		force := false
+		select {
+		case <-stopCh:
+			return
+		case <-hupChan:
+			defaultLogger.info("Got SIGHUP signal, reloading config file", "configFile", parameters.configFile)
+			force = true
+		case <-ticker.C:
+		}
+
+		content, err := os.ReadFile(parameters.configFile)
+		if err != nil {
+			defaultLogger.error("Failed to read config file, keep the last good config", "configFile", parameters.configFile, "error", err)
+			whsvr.recordConfigLoad(err)
+			loaded = nil
+			continue
+		}
+		if !force && bytes.Equal(content, loaded) {
+			continue
+		}
+
+		// the content checked is parsed, the file may be changed again since read
+		policy, err := parseWebhookPolicy(parameters, content)
+		loaded = content
+		whsvr.recordConfigLoad(err)
+		if err != nil {
+			defaultLogger.error("Failed to reload config, keep the last good config", "error", err)
+			continue
+		}
+		whsvr.setPolicy(policy)
+		defaultLogger.info("Reloaded config file", "configFile", parameters.configFile)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func writeConfigFile(t *testing.T, file, content string) {
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewWebhookPolicy(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config webhookConfig
+		err    bool
+	}{
+		{"test with default config", webhookConfig{}, false},
+		{"test with custom profile", webhookConfig{Profiles: map[string][]string{"Proc": {"/proc/meminfo", "/proc/uptime"}}}, false},
+		{"test with empty profile", webhookConfig{Profiles: map[string][]string{"proc": {}}}, true},
+		{"test with unsupported profile file", webhookConfig{Profiles: map[string][]string{"proc": {"/proc/slabinfo"}}}, true},
+		{"test with nested profile files", webhookConfig{LxcfsVersion: "5.0.3", Profiles: map[string][]string{"cpu": {"/sys/devices/system/cpu", "/sys/devices/system/cpu/online"}}}, true},
+		{"test with audit mode", webhookConfig{Mode: policyModeAudit, AuditNamespaces: []string{"demo"}}, false},
+		{"test with invalid mode", webhookConfig{Mode: "dry-run"}, true},
+		{"test with invalid annotation prefix", webhookConfig{AnnotationPrefix: "Lxcfs_Webhook"}, true},
+		{"test with invalid operation", webhookConfig{MutatingOperations: []admissionv1.Operation{"PATCH"}}, true},
+		{"test with invalid conflict strategy", webhookConfig{ConflictStrategy: "unknown"}, true},
+		{"test with invalid LXCFS version", webhookConfig{LxcfsVersion: "latest"}, true},
+		{"test with invalid LXCFS mount", webhookConfig{LxcfsMountDir: "/lxcfs"}, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+
+		policy, err := newWebhookPolicy(testCase.config)
+		assert.Equal(t, err != nil, testCase.err)
+		if err == nil {
+			assert.DeepEqual(t, policy.IgnoredNamespaces, ignoredNamespaces)
+			assert.Equal(t, policy.profiles[lxcfsProfileFull] != nil, true)
+		}
+	}
+}
+
+func TestLoadWebhookPolicy(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	parameters := WhSvrParameters{
+		conflictStrategy: conflictStrategyOverride,
+		lxcfsVersion:     defaultLxcfsVersion,
+		configFile:       configFile,
+	}
+
+	writeConfigFile(t, configFile, `
+ignoredNamespaces: [kube-system]
+annotationPrefix: lxcfs.example.com
+mutateWorkloads: true
+lxcfsVersion: 5.0.3
+profiles:
+  slab: [/proc/slabinfo]
+`)
+	policy, _, err := loadWebhookPolicy(&parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, policy.IgnoredNamespaces, []string{metav1.NamespaceSystem})
+	assert.Equal(t, policy.AnnotationPrefix, "lxcfs.example.com")
+	assert.Equal(t, policy.ConflictStrategy, conflictStrategyOverride)
+	assert.Equal(t, policy.MutateWorkloads, true)
+	assert.Equal(t, policy.lxcfsVersion.String(), "5.0.3")
+	assert.DeepEqual(t, policy.profiles["slab"], []string{"/proc/slabinfo"})
+
+	writeConfigFile(t, configFile, "unknownField: true\n")
+	_, _, err = loadWebhookPolicy(&parameters)
+	assert.Equal(t, err != nil, true)
+}
+
+func TestWebhookServerMutateWithAnnotationPrefix(t *testing.T) {
+	whsvr := NewWebhookServer()
+	policy, err := newWebhookPolicy(webhookConfig{AnnotationPrefix: "lxcfs.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	whsvr.setPolicy(policy)
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		except      []string
+	}{
+		{"test with default prefix ignored", map[string]string{admissionWebhookAnnotationEnableKey: "false"}, []string{
+			"\"/spec/containers/0/volumeMounts\"",
+			"\"/metadata/annotations/lxcfs.example.com~1status\",\"value\":\"mutated\"",
+		}},
+		{"test with configured prefix", map[string]string{"lxcfs.example.com/enable": "false"}, []string{
+			"\"/metadata/annotations/lxcfs.example.com~1status\",\"value\":\"skip\"",
+		}},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+
+		pod := corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: testCase.annotations},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx"}}},
+		}
+		ar := workloadAdmissionReview(t, validMutatingKindList[0], admissionv1.Create, pod)
+		admissionResponse := whsvr.mutate(ar)
+		patch := string(admissionResponse.Patch)
+		for _, except := range testCase.except {
+			assert.Equal(t, strings.Contains(patch, except), true, "patch %s not contain %s", patch, except)
+		}
+	}
+}
+
+func TestWebhookServerWatchConfig(t *testing.T) {
+	interval := configReloadInterval
+	configReloadInterval = 10 * time.Millisecond
+	defer func() {
+		configReloadInterval = interval
+	}()
+
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	parameters := WhSvrParameters{configFile: configFile}
+	writeConfigFile(t, configFile, "conflictStrategy: override\n")
+
+	whsvr := NewWebhookServer()
+	policy, loaded, err := loadWebhookPolicy(&parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	whsvr.setPolicy(policy)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go whsvr.watchConfig(&parameters, loaded, stopCh)
+
+	waitPolicy := func(strategy string) {
+		for i := 0; i < 100 && whsvr.currentPolicy().ConflictStrategy != strategy; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, whsvr.currentPolicy().ConflictStrategy, strategy)
+	}
+
+	writeConfigFile(t, configFile, "conflictStrategy: skip-conflicting-mounts\n")
+	waitPolicy(conflictStrategySkipConflictingMounts)
+
+	// the last good policy is kept
+	writeConfigFile(t, configFile, "conflictStrategy: unknown\n")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, whsvr.currentPolicy().ConflictStrategy, conflictStrategySkipConflictingMounts)
+	assert.Equal(t, testutil.ToFloat64(configLastReloadSuccessful), float64(0))
+
+	writeConfigFile(t, configFile, "conflictStrategy: skip-pod\n")
+	waitPolicy(conflictStrategySkipPod)
+	assert.Equal(t, testutil.ToFloat64(configLastReloadSuccessful), float64(1))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// skip the whole pod if any LXCFS volume mount conflict with pod
+	conflictStrategySkipPod = "skip-pod"
+	// skip the LXCFS volume mounts conflict with container's and mount the others
+	conflictStrategySkipConflictingMounts = "skip-conflicting-mounts"
+	// replace the container's volume mounts conflict with LXCFS files
+	conflictStrategyOverride = "override"
+
+	conflictActionSkipped  = "skipped"
+	conflictActionReplaced = "replaced"
+)
+
+var conflictStrategies = []string{
+	conflictStrategySkipPod,
+	conflictStrategySkipConflictingMounts,
+	conflictStrategyOverride,
+}
+
+// volumeMountConflict the conflict between pod and LXCFS volume or volume mount, and how it resolved
+type volumeMountConflict struct {
+	Container string `json:"container,omitempty"`
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath,omitempty"`
+	Action    string `json:"action"`
+	Reason    string `json:"reason"`
+}
+
+// containerVolumeMounts the LXCFS volume mounts to patch of a container
+type containerVolumeMounts struct {
+	podContainer
+	added    []corev1.VolumeMount       // volume mounts append to the container
+	replaced map[int]corev1.VolumeMount // container's volume mounts replaced by LXCFS volume mounts, key is the index
+}
+
+// validConflictStrategy check whether the conflict strategy is supported
+func validConflictStrategy(strategy string) bool {
+	for _, s := range conflictStrategies {
+		if s == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// conflictStrategyRequired get the conflict strategy chosen by the pod annotation, use defaultStrategy if not set
+func conflictStrategyRequired(annotations map[string]string, defaultStrategy string) (string, error) {
+	strategy := strings.ToLower(strings.TrimSpace(annotations[admissionWebhookAnnotationConflictStrategyKey]))
+	if strategy == "" {
+		strategy = defaultStrategy
+	}
+	if strategy == "" {
+		return conflictStrategySkipPod, nil
+	}
+	if !validConflictStrategy(strategy) {
+		return "", fmt.Errorf("unknown conflict strategy %q", strategy)
+	}
+	return strategy, nil
+}
+
+// resolveVolumeMountConflict resolve conflict between container's volume mounts and the LXCFS volume mount,
+// return the index of container's volume mount to be replaced, -1 if not replace it,
+// conflict is nil if no conflict found
+func resolveVolumeMountConflict(c podContainer, added corev1.VolumeMount, strategy string) (int, *volumeMountConflict) {
+	for idx, origin := range c.container.VolumeMounts {
+		var reason string
+		if origin.Name == added.Name {
+			reason = fmt.Sprintf("volume %s already mounted at %s", origin.Name, origin.MountPath)
+		} else if path.Clean(origin.MountPath) == path.Clean(added.MountPath) {
+			reason = fmt.Sprintf("mount path already used by volume %s", origin.Name)
+		} else {
+			continue
+		}
+
+		conflict := &volumeMountConflict{
+			Container: c.container.Name,
+			Name:      added.Name,
+			MountPath: added.MountPath,
+			Action:    conflictActionSkipped,
+			Reason:    reason,
+		}
+		// only the LXCFS files mounted by SubPath can override the container's
+		if strategy == conflictStrategyOverride && origin.Name != added.Name && added.SubPath != "" {
+			conflict.Action = conflictActionReplaced
+			return idx, conflict
+		}
+		return -1, conflict
+	}
+	return -1, nil
+}
+
+// patchConflictCheck check conflicts between the pod and LXCFS volumes and volume mounts, resolve the conflicts by strategy,
+// return the volume mounts to patch for each container and the conflicts found,
+// conflict is true if the pod should not be mutated
+func patchConflictCheck(pod *corev1.Pod, volumesTemplate []corev1.Volume, volumeMountsTemplate []corev1.VolumeMount, strategy string) (mounts []containerVolumeMounts, conflicts []volumeMountConflict, conflict bool) {
+	// LXCFS volume can't be added if the volume name is already used, no matter which strategy
+	if volumeConflictCheck(pod.Spec.Volumes, volumesTemplate) {
+		conflicts = append(conflicts, volumeMountConflict{
+			Name:   lxcfsVol,
+			Action: conflictActionSkipped,
+			Reason: "volume name already used by pod",
+		})
+		return nil, conflicts, true
+	}
+
+	for _, c := range mutatingContainers(pod) {
+		cvm := containerVolumeMounts{podContainer: c}
+		for _, added := range volumeMountsTemplate {
+			idx, vmc := resolveVolumeMountConflict(c, added, strategy)
+			if vmc == nil {
+				cvm.added = append(cvm.added, added)
+				continue
+			}
+
+			conflicts = append(conflicts, *vmc)
+			if idx >= 0 {
+				if cvm.replaced == nil {
+					cvm.replaced = make(map[int]corev1.VolumeMount)
+				}
+				cvm.replaced[idx] = added
+			}
+		}
+		mounts = append(mounts, cvm)
+	}
+
+	if strategy == conflictStrategySkipPod && len(conflicts) > 0 {
+		return nil, conflicts, true
+	}
+	return mounts, conflicts, false
+}
+
+// conflictsAnnotation format the conflicts as annotation value
+func conflictsAnnotation(conflicts []volumeMountConflict) string {
+	value, err := json.Marshal(conflicts)
+	if err != nil {
+		return ""
+	}
+	return string(value)
+}
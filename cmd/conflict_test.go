@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestConflictStrategyRequired(t *testing.T) {
+	testCases := []struct {
+		annotations     map[string]string
+		defaultStrategy string
+		except          string
+		err             bool
+	}{
+		{nil, "", conflictStrategySkipPod, false},
+		{nil, conflictStrategyOverride, conflictStrategyOverride, false},
+		{map[string]string{admissionWebhookAnnotationConflictStrategyKey: "Skip-Conflicting-Mounts"}, conflictStrategyOverride, conflictStrategySkipConflictingMounts, false},
+		{map[string]string{admissionWebhookAnnotationConflictStrategyKey: "unknown"}, conflictStrategySkipPod, "", true},
+	}
+
+	for _, testCase := range testCases {
+		strategy, err := conflictStrategyRequired(testCase.annotations, testCase.defaultStrategy)
+		assert.Equal(t, err != nil, testCase.err)
+		assert.Equal(t, strategy, testCase.except)
+	}
+}
+
+func TestPatchConflictCheckStrategy(t *testing.T) {
+	volumeMounts := testLxcfsMount.volumeMounts([]string{"/proc/meminfo", "/proc/cpuinfo"})
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "app",
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: "config", MountPath: "/etc/app"},
+						{Name: "fake-meminfo", MountPath: "/proc/meminfo", SubPath: "meminfo"},
+						{Name: "lxc", MountPath: "/var/lib/lxc"},
+					},
+				},
+				{Name: "sidecar"},
+			},
+		},
+	}
+
+	testCases := []struct {
+		strategy  string
+		conflict  bool
+		added     []int
+		replaced  []int
+		conflicts []string
+	}{
+		{conflictStrategySkipPod, true, nil, nil, []string{"/proc/meminfo skipped", "/var/lib/lxc/ skipped"}},
+		{conflictStrategySkipConflictingMounts, false, []int{1, 3}, []int{0, 0}, []string{"/proc/meminfo skipped", "/var/lib/lxc/ skipped"}},
+		{conflictStrategyOverride, false, []int{1, 3}, []int{1, 0}, []string{"/proc/meminfo replaced", "/var/lib/lxc/ skipped"}},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for strategy: %s", testCase.strategy)
+
+		mounts, conflicts, conflict := patchConflictCheck(&pod, volumesTemplate, volumeMounts, testCase.strategy)
+		assert.Equal(t, conflict, testCase.conflict)
+
+		var conflictsGot []string
+		for _, c := range conflicts {
+			assert.Equal(t, c.Container, "app")
+			conflictsGot = append(conflictsGot, c.MountPath+" "+c.Action)
+		}
+		assert.DeepEqual(t, conflictsGot, testCase.conflicts)
+
+		if testCase.conflict {
+			assert.Equal(t, len(mounts), 0)
+			continue
+		}
+		assert.Equal(t, len(mounts), 2)
+		for idx, m := range mounts {
+			assert.Equal(t, len(m.added), testCase.added[idx])
+			assert.Equal(t, len(m.replaced), testCase.replaced[idx])
+		}
+	}
+}
+
+func TestCreatePatchWithReplacedVolumeMount(t *testing.T) {
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "app",
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: "config", MountPath: "/etc/app"},
+						{Name: "fake-meminfo", MountPath: "/proc/meminfo", SubPath: "meminfo"},
+					},
+				},
+			},
+		},
+	}
+
+	mounts, conflicts, _ := patchConflictCheck(&pod, volumesTemplate, testLxcfsMount.volumeMounts([]string{"/proc/meminfo"}), conflictStrategyOverride)
+	patch, err := createPatch(&pod, "", volumesTemplate, mounts, nil, nil, map[string]string{
+		admissionWebhookAnnotationConflictsKey: conflictsAnnotation(conflicts),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	var patches []patchOperation
+	if err := json.Unmarshal(patch, &patches); err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, patches[0].Op, "replace")
+	assert.Equal(t, patches[0].Path, "/spec/containers/0/volumeMounts/1")
+	assert.Equal(t, patches[1].Op, "add")
+	assert.Equal(t, patches[1].Path, "/spec/containers/0/volumeMounts/-")
+	assert.Equal(t, strings.Contains(string(patch), "mount path already used by volume fake-meminfo"), true)
+}
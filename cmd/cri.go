@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// the CRI runtime endpoints tried in order if not set, the same as crictl
+var defaultRuntimeEndpoints = []string{
+	"/run/containerd/containerd.sock",
+	"/run/crio/crio.sock",
+	"/var/run/cri-dockerd.sock",
+	"/var/run/dockershim.sock",
+}
+
+// lxcfsContainer the running container of a mutated pod
+type lxcfsContainer struct {
+	id           string
+	name         string
+	podNamespace string
+	podName      string
+	pid          int      // the container init process on host
+	files        []string // the LXCFS files should be bind-mounted in the container
+	ephemeral    bool     // the ephemeral container, the LXCFS files are bind-mounted by the agent only
+}
+
+// dialRuntime connect the CRI runtime service listening on the unix socket endpoint,
+// the first existing default endpoint is used if endpoint is empty
+func dialRuntime(ctx context.Context, endpoint string) (*grpc.ClientConn, error) {
+	if endpoint == "" {
+		for _, e := range defaultRuntimeEndpoints {
+			if info, err := os.Stat(e); err == nil && info.Mode()&os.ModeSocket != 0 {
+				endpoint = e
+				break
+			}
+		}
+		if endpoint == "" {
+			return nil, fmt.Errorf("no CRI runtime endpoint found in %v", defaultRuntimeEndpoints)
+		}
+	}
+
+	return grpc.DialContext(ctx, strings.TrimPrefix(endpoint, "unix://"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}),
+	)
+}
+
+// lxcfsContainers list the running containers of the ready mutated pods, except the LXCFS pods selected by lxcfsPods.
+// The pod annotations are read with annotationPrefix configured for the webhook, the default if empty.
+// The containers failed to inspect are skipped and returned in error.
+func lxcfsContainers(ctx context.Context, runtime runtimeapi.RuntimeServiceClient, lxcfsPods labels.Selector, m *lxcfsMount, annotationPrefix string) ([]lxcfsContainer, error) {
+	sandboxes, err := runtime.ListPodSandbox(ctx, &runtimeapi.ListPodSandboxRequest{
+		Filter: &runtimeapi.PodSandboxFilter{State: &runtimeapi.PodSandboxStateValue{State: runtimeapi.PodSandboxState_SANDBOX_READY}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pod sandboxes: %v", err)
+	}
+
+	var containers []lxcfsContainer
+	var errs []error
+	for _, sandbox := range sandboxes.Items {
+		annotations := importAnnotations(annotationPrefix, sandbox.Annotations)
+		if strings.ToLower(annotations[admissionWebhookAnnotationStatusKey]) != admissionWebhookSuccessFlag ||
+			lxcfsPods.Matches(labels.Set(sandbox.Labels)) {
+			continue
+		}
+
+		list, err := runtime.ListContainers(ctx, &runtimeapi.ListContainersRequest{
+			Filter: &runtimeapi.ContainerFilter{
+				PodSandboxId: sandbox.Id,
+				State:        &runtimeapi.ContainerStateValue{State: runtimeapi.ContainerState_CONTAINER_RUNNING},
+			},
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list containers of pod %s/%s: %v", sandbox.Metadata.GetNamespace(), sandbox.Metadata.GetName(), err))
+			continue
+		}
+
+		files := annotationList(annotations, admissionWebhookAnnotationMutatedFilesKey)
+		mutated := annotationList(annotations, admissionWebhookAnnotationMutatedContainersKey)
+		for _, container := range list.Containers {
+			c, err := inspectContainer(ctx, runtime, container.Id, m, files, mutated)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to inspect container %s of pod %s/%s: %v",
+					container.Metadata.GetName(), sandbox.Metadata.GetNamespace(), sandbox.Metadata.GetName(), err))
+				continue
+			}
+			if c == nil {
+				continue
+			}
+			c.podNamespace, c.podName = sandbox.Metadata.GetNamespace(), sandbox.Metadata.GetName()
+			containers = append(containers, *c)
+		}
+	}
+	return containers, utilerrors.NewAggregate(errs)
+}
+
+// inspectContainer get the pid and the LXCFS files of the container, nil if no LXCFS file should be mounted in it.
+// The LXCFS files are the mutated files of the pod bind-mounted from the LXCFS volume. The containers mounted
+// the whole LXCFS volume only and not in the mutated containers of the pod are the ephemeral containers,
+// which subPath is forbidden, the mutated files not covered by their own volumes are bind-mounted by the agent.
+// The readiness guard mounts the whole LXCFS volume only to wait for LXCFS, it's skipped.
+func inspectContainer(ctx context.Context, runtime runtimeapi.RuntimeServiceClient, id string, m *lxcfsMount, mutatedFiles, mutatedContainers map[string]bool) (*lxcfsContainer, error) {
+	resp, err := runtime.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{ContainerId: id, Verbose: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	volumeMounted := false
+	mountPoints := make(map[string]bool)
+	for _, mount := range resp.Status.GetMounts() {
+		mountPoints[mount.ContainerPath] = true
+		if path.Clean(mount.ContainerPath) == path.Clean(m.hostRoot) && path.Clean(mount.HostPath) == path.Clean(m.hostRoot) {
+			volumeMounted = true
+		} else if mutatedFiles[mount.ContainerPath] && m.lxcfsHostPath(mount.HostPath) {
+			files = append(files, mount.ContainerPath)
+		}
+	}
+	name := resp.Status.GetMetadata().GetName()
+	ephemeral := len(files) == 0 && volumeMounted && !mutatedContainers[name] && name != readinessGuardContainerName
+	if ephemeral {
+		for _, f := range lxcfsFileCatalogue {
+			if mutatedFiles[f.path] && !mountPoints[f.path] {
+				files = append(files, f.path)
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	// the pid is in the verbose info of containerd and CRI-O
+	var info struct {
+		Pid int `json:"pid"`
+	}
+	if err := json.Unmarshal([]byte(resp.Info["info"]), &info); err != nil {
+		return nil, fmt.Errorf("invalid verbose info: %v", err)
+	}
+	if info.Pid <= 0 {
+		return nil, fmt.Errorf("pid not found in verbose info")
+	}
+
+	return &lxcfsContainer{
+		id:        id,
+		name:      name,
+		pid:       info.Pid,
+		files:     files,
+		ephemeral: ephemeral,
+	}, nil
+}
+
+// lxcfsHostPath check whether the host path of a container mount is in the LXCFS volume, kubelet bind-mounts
+// the subPath of a volume at volume-subpaths/<volume name>/ of the pod directory before passing it to the runtime.
+// The volumes of the container at the same paths as the skipped conflicting LXCFS files are not matched.
+func (m *lxcfsMount) lxcfsHostPath(hostPath string) bool {
+	return strings.HasPrefix(path.Clean(hostPath), path.Join(m.hostRoot, m.mountDir)+"/") ||
+		strings.Contains(hostPath, "/volume-subpaths/"+lxcfsVol+"/")
+}
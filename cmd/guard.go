@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// the init container prepended to the mutated pods, so the app containers start after LXCFS is ready on the node
+const readinessGuardContainerName = "lxcfs-readiness-guard"
+
+// the LXCFS file checked by the readiness guard, seen at the same path under the LXCFS mount point
+const readinessGuardFile = "/proc/meminfo"
+
+const (
+	// the readiness guard fails when timed out, the pod is not started until LXCFS ready
+	readinessGuardFailurePolicyFail = "Fail"
+	// the readiness guard succeeds when timed out, the app containers start without LXCFS
+	readinessGuardFailurePolicyIgnore = "Ignore"
+)
+
+var readinessGuardFailurePolicies = []string{readinessGuardFailurePolicyFail, readinessGuardFailurePolicyIgnore}
+
+const (
+	defaultReadinessGuardImage   = "busybox:1.36"
+	defaultReadinessGuardTimeout = time.Minute
+)
+
+// readinessGuardScript wait until the LXCFS file is a regular file on the LXCFS mount and readable,
+// the LXCFS mount point is propagated from host, so LXCFS mounted after the guard started is seen
+const readinessGuardScript = `deadline=$(( $(date +%s) + LXCFS_TIMEOUT_SECONDS ))
+until grep -q " $LXCFS_MOUNT_POINT fuse.lxcfs " /proc/self/mounts && [ -f "$LXCFS_FILE" ] && [ -n "$(head -c 1 "$LXCFS_FILE" 2>/dev/null)" ]; do
+  if [ "$(date +%s)" -ge "$deadline" ]; then
+    msg="LXCFS file $LXCFS_FILE is not ready after ${LXCFS_TIMEOUT_SECONDS}s, check the LXCFS DaemonSet pod on the node"
+    if [ "$LXCFS_FAILURE_POLICY" = "Ignore" ]; then
+      echo "$msg, start the containers without LXCFS"
+      exit 0
+    fi
+    echo "$msg" >&2
+    exit 1
+  fi
+  sleep 1
+done
+echo "LXCFS file $LXCFS_FILE is ready"
+`
+
+// readinessGuardConfig the init container blocks the app containers until LXCFS ready
+type readinessGuardConfig struct {
+	Enabled       bool            `json:"enabled,omitempty"`
+	Image         string          `json:"image,omitempty"`
+	Timeout       metav1.Duration `json:"timeout,omitempty"`
+	FailurePolicy string          `json:"failurePolicy,omitempty"` // Fail or Ignore when timed out
+}
+
+// validReadinessGuardFailurePolicy check whether the failure policy of readiness guard is supported
+func validReadinessGuardFailurePolicy(policy string) bool {
+	for _, p := range readinessGuardFailurePolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// readinessGuard build the readiness guard init container by config, nil if it's disabled.
+// The whole LXCFS volume is mounted only, so no stray directory is created by the subPath before LXCFS mounted.
+func (m *lxcfsMount) readinessGuard(config readinessGuardConfig) (*corev1.Container, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	if config.Image == "" {
+		config.Image = defaultReadinessGuardImage
+	}
+	if config.Timeout.Duration == 0 {
+		config.Timeout.Duration = defaultReadinessGuardTimeout
+	}
+	if config.FailurePolicy == "" {
+		config.FailurePolicy = readinessGuardFailurePolicyFail
+	}
+	if config.Timeout.Duration < time.Second {
+		return nil, fmt.Errorf("invalid readiness guard timeout %v, must be at least 1s", config.Timeout.Duration)
+	}
+	if !validReadinessGuardFailurePolicy(config.FailurePolicy) {
+		return nil, fmt.Errorf("invalid readiness guard failure policy %q, must be one of %v", config.FailurePolicy, readinessGuardFailurePolicies)
+	}
+
+	mountPoint := path.Join(m.hostRoot, m.mountDir)
+	allowPrivilegeEscalation, readOnlyRootFilesystem := false, true
+	pod := &corev1.Pod{Spec: corev1.PodSpec{InitContainers: []corev1.Container{{
+		Name:    readinessGuardContainerName,
+		Image:   config.Image,
+		Command: []string{"/bin/sh", "-c", readinessGuardScript},
+		Env: []corev1.EnvVar{
+			{Name: "LXCFS_MOUNT_POINT", Value: mountPoint},
+			{Name: "LXCFS_FILE", Value: path.Join(mountPoint, readinessGuardFile)},
+			{Name: "LXCFS_TIMEOUT_SECONDS", Value: strconv.Itoa(int(config.Timeout.Seconds()))},
+			{Name: "LXCFS_FAILURE_POLICY", Value: config.FailurePolicy},
+		},
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("50m"),
+				corev1.ResourceMemory: resource.MustParse("16Mi"),
+			},
+		},
+		VolumeMounts: []corev1.VolumeMount{{
+			Name:      lxcfsVol,
+			MountPath: m.hostRoot,
+			ReadOnly:  true,
+			MountPropagation: func() *corev1.MountPropagationMode {
+				pt := corev1.MountPropagationHostToContainer
+				return &pt
+			}(),
+		}},
+		TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+		SecurityContext: &corev1.SecurityContext{
+			AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+			ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+		},
+	}}}}
+	// Workaround: https://github.com/kubernetes/kubernetes/issues/57982
+	defaulter.Default(pod)
+
+	return &pod.Spec.InitContainers[0], nil
+}
+
+// patchReadinessGuard prepend the readiness guard to the init containers, nothing to patch if the pod has it already.
+// It should be the last patch of the init containers, as the indexes of the init containers are shifted.
+func patchReadinessGuard(target []corev1.Container, guard *corev1.Container) (patches []patchOperation) {
+	if guard == nil {
+		return nil
+	}
+	for _, c := range target {
+		if c.Name == guard.Name {
+			return nil
+		}
+	}
+
+	if len(target) == 0 {
+		return append(patches, patchOperation{
+			Op:    "add",
+			Path:  "/spec/initContainers",
+			Value: []corev1.Container{*guard},
+		})
+	}
+	return append(patches, patchOperation{
+		Op:    "add",
+		Path:  "/spec/initContainers/0",
+		Value: *guard,
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReadinessGuard(t *testing.T) {
+	mount, err := newLxcfsMount(defaultLxcfsHostRoot, defaultLxcfsMountDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name          string
+		config        readinessGuardConfig
+		valid         bool
+		image         string
+		timeout       string
+		failurePolicy string
+	}{
+		{"test with defaults", readinessGuardConfig{Enabled: true}, true, defaultReadinessGuardImage, "60", readinessGuardFailurePolicyFail},
+		{"test with config", readinessGuardConfig{Enabled: true, Image: "alpine:3.16", Timeout: metav1.Duration{Duration: 90 * time.Second}, FailurePolicy: readinessGuardFailurePolicyIgnore},
+			true, "alpine:3.16", "90", readinessGuardFailurePolicyIgnore},
+		{"test with invalid timeout", readinessGuardConfig{Enabled: true, Timeout: metav1.Duration{Duration: time.Millisecond}}, false, "", "", ""},
+		{"test with invalid failure policy", readinessGuardConfig{Enabled: true, FailurePolicy: "Retry"}, false, "", "", ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+		guard, err := mount.readinessGuard(testCase.config)
+		assert.Equal(t, err == nil, testCase.valid, "error: %v", err)
+		if !testCase.valid {
+			continue
+		}
+
+		assert.Equal(t, guard.Name, readinessGuardContainerName)
+		assert.Equal(t, guard.Image, testCase.image)
+		assert.Equal(t, guard.ImagePullPolicy, corev1.PullIfNotPresent)
+		env := make(map[string]string)
+		for _, e := range guard.Env {
+			env[e.Name] = e.Value
+		}
+		assert.DeepEqual(t, env, map[string]string{
+			"LXCFS_MOUNT_POINT":     "/var/lib/lxc/lxcfs",
+			"LXCFS_FILE":            "/var/lib/lxc/lxcfs/proc/meminfo",
+			"LXCFS_TIMEOUT_SECONDS": testCase.timeout,
+			"LXCFS_FAILURE_POLICY":  testCase.failurePolicy,
+		})
+		// the whole LXCFS volume only, no LXCFS file mounted by subPath
+		assert.Equal(t, len(guard.VolumeMounts), 1)
+		assert.Equal(t, guard.VolumeMounts[0].MountPath, defaultLxcfsHostRoot)
+		assert.Equal(t, guard.VolumeMounts[0].SubPath, "")
+		assert.Equal(t, *guard.VolumeMounts[0].MountPropagation, corev1.MountPropagationHostToContainer)
+	}
+
+	guard, err := mount.readinessGuard(readinessGuardConfig{})
+	assert.NilError(t, err)
+	assert.Equal(t, guard == nil, true)
+}
+
+func TestPatchReadinessGuard(t *testing.T) {
+	guard := &corev1.Container{Name: readinessGuardContainerName}
+
+	testCases := []struct {
+		name   string
+		target []corev1.Container
+		except []patchOperation
+	}{
+		{"test without init containers", nil,
+			[]patchOperation{{Op: "add", Path: "/spec/initContainers", Value: []corev1.Container{*guard}}}},
+		{"test with init containers", []corev1.Container{{Name: "init"}},
+			[]patchOperation{{Op: "add", Path: "/spec/initContainers/0", Value: *guard}}},
+		{"test with readiness guard already", []corev1.Container{{Name: "init"}, *guard}, nil},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+		assert.DeepEqual(t, patchReadinessGuard(testCase.target, guard), testCase.except)
+	}
+	assert.Equal(t, len(patchReadinessGuard(nil, nil)), 0)
+}
+
+func TestWebhookServerMutateWithReadinessGuard(t *testing.T) {
+	whsvr := NewWebhookServer()
+
+	for _, enabled := range []bool{false, true} {
+		policy, err := newWebhookPolicy(webhookConfig{ReadinessGuard: readinessGuardConfig{Enabled: enabled}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		whsvr.setPolicy(policy)
+
+		admissionResponse := whsvr.mutate(GetAdmissionReviewExample())
+		assert.Equal(t, admissionResponse.Allowed, true)
+		var patches []patchOperation
+		assert.NilError(t, json.Unmarshal(admissionResponse.Patch, &patches))
+
+		guarded := false
+		for idx, patch := range patches {
+			if !strings.HasPrefix(patch.Path, "/spec/initContainers") {
+				continue
+			}
+			guarded = true
+			// the init containers are not mutated after the readiness guard prepended
+			for _, p := range patches[idx+1:] {
+				assert.Equal(t, strings.HasPrefix(p.Path, "/spec/initContainers"), false)
+			}
+		}
+		assert.Equal(t, guarded, enabled)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// buildInfo the version information set at build time
+type buildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+	GoVersion string `json:"goVersion"`
+	BuildTime string `json:"buildTime"`
+}
+
+func currentBuildInfo() buildInfo {
+	return buildInfo{
+		Version:   Version,
+		GitCommit: GitCommit,
+		GoVersion: GoVersion,
+		BuildTime: BuildTime,
+	}
+}
+
+// ready check whether the webhook server is ready to serve admission requests
+func (whsvr *WebhookServer) ready() error {
+	if atomic.LoadInt32(&whsvr.shutdown) != 0 {
+		return errors.New("webhook server is shutting down")
+	}
+
+	if whsvr.certificate == nil {
+		return errors.New("no certificate loaded")
+	}
+	pair, err := whsvr.certificate.GetCertificate(nil)
+	if err != nil || pair == nil || pair.Leaf == nil {
+		return errors.New("no certificate loaded")
+	}
+	if time.Now().After(pair.Leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %v", pair.Leaf.NotAfter)
+	}
+
+	if whsvr.namespaces != nil && !whsvr.namespaces.synced() {
+		return errors.New("namespaces cache not synced")
+	}
+
+	if whsvr.nodeFiles != nil && !whsvr.nodeFiles.synced() {
+		return errors.New("nodes cache not synced")
+	}
+
+	if whsvr.policies != nil && !whsvr.policies.hasSynced() {
+		return errors.New("LxcfsPolicy cache not synced")
+	}
+
+	// the reload errors don't fail the readiness, the last good config is still in use
+	if atomic.LoadInt32(&whsvr.configValid) == 0 {
+		return errors.New("no valid config loaded")
+	}
+	return nil
+}
+
+// recordConfigLoad record the result of loading config file, err is nil if loaded
+func (whsvr *WebhookServer) recordConfigLoad(err error) {
+	recordConfigReload(err == nil)
+	if err == nil {
+		atomic.StoreInt32(&whsvr.configValid, 1)
+	}
+}
+
+// healthz liveness probe, the webhook server is alive if it can respond
+func (whsvr *WebhookServer) healthz(w http.ResponseWriter, _ *http.Request) {
+	if _, err := fmt.Fprintf(w, "ok"); err != nil {
+		defaultLogger.error("Can't write response", "error", err)
+	}
+}
+
+// readyz readiness probe, fails when no valid certificate, invalid config or shutting down
+func (whsvr *WebhookServer) readyz(w http.ResponseWriter, _ *http.Request) {
+	if err := whsvr.ready(); err != nil {
+		defaultLogger.warning("Webhook server is not ready", "error", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if _, err := fmt.Fprintf(w, "ok"); err != nil {
+		defaultLogger.error("Can't write response", "error", err)
+	}
+}
+
+// version respond the build version information in JSON
+func (whsvr *WebhookServer) version(w http.ResponseWriter, _ *http.Request) {
+	resp, err := json.Marshal(currentBuildInfo())
+	if err != nil {
+		defaultLogger.error("Can't encode response", "error", err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		defaultLogger.error("Can't write response", "error", err)
+	}
+}
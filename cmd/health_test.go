@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestWebhookServerReadyz(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeKeyPairFiles(t, certFile, keyFile, "localhost")
+	reloader, err := newKeyPairReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	whsvr := NewWebhookServer()
+	testCases := []struct {
+		name   string
+		setup  func()
+		status int
+	}{
+		{"test without certificate", func() {}, http.StatusServiceUnavailable},
+		{"test with invalid config", func() {
+			whsvr.certificate = reloader
+			whsvr.recordConfigLoad(errors.New("invalid"))
+		}, http.StatusServiceUnavailable},
+		{"test with config loaded", func() { whsvr.recordConfigLoad(nil) }, http.StatusOK},
+		{"test with config reload failed", func() { whsvr.recordConfigLoad(errors.New("invalid")) }, http.StatusOK},
+		{"test with nodes cache not synced", func() { whsvr.nodeFiles = &nodeFilesWatcher{synced: func() bool { return false }} }, http.StatusServiceUnavailable},
+		{"test with nodes cache synced", func() { whsvr.nodeFiles.synced = func() bool { return true } }, http.StatusOK},
+		{"test with shutting down", func() { atomic.StoreInt32(&whsvr.shutdown, 1) }, http.StatusServiceUnavailable},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+
+		testCase.setup()
+		rr := httptest.NewRecorder()
+		whsvr.readyz(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		assert.Equal(t, rr.Code, testCase.status)
+	}
+}
+
+func TestStartWebhookServerWithProbePort(t *testing.T) {
+	dir := t.TempDir()
+	parameters := WhSvrParameters{
+		port:      8444,
+		probePort: 8081,
+		certFile:  filepath.Join(dir, "tls.crt"),
+		keyFile:   filepath.Join(dir, "tls.key"),
+	}
+	writeKeyPairFiles(t, parameters.certFile, parameters.keyFile, "localhost")
+
+	version := Version
+	Version = "v1.0.0"
+	defer func() {
+		Version = version
+	}()
+
+	whsvr, err := startWebhookServer(&parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = whsvr.server.Close()
+		_ = whsvr.probeServer.Close()
+	}()
+
+	for path, except := range map[string]string{"/healthz": "ok", "/readyz": "ok"} {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d%s", parameters.probePort, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		assert.Equal(t, string(body), except)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/version", parameters.probePort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var info buildInfo
+	assert.NilError(t, json.NewDecoder(resp.Body).Decode(&info))
+	assert.Equal(t, info.Version, "v1.0.0")
+}
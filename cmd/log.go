@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	logFormatText = "text" // written by klog, the klog flags take effect
+	logFormatJSON = "json" // one JSON object per line written to stderr
+)
+
+type logLevel int
+
+const (
+	logLevelDebug logLevel = iota
+	logLevelInfo
+	logLevelWarning
+	logLevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warning", "error"}
+
+func (level logLevel) String() string {
+	return logLevelNames[level]
+}
+
+var (
+	logOutputFormat           = logFormatText
+	logOutputLevel            = logLevelInfo
+	logOutput       io.Writer = os.Stderr // output of JSON format
+	logOutputLock   sync.Mutex
+)
+
+func init() {
+	// the klog flags, e.g. -v, -logtostderr and -log_dir, are parsed with the command line
+	klog.InitFlags(nil)
+}
+
+// setupLogging set the log format and the minimum level to write
+func setupLogging(format, level string) error {
+	if format != logFormatText && format != logFormatJSON {
+		return fmt.Errorf("invalid log format %q, must be one of %v", format, []string{logFormatText, logFormatJSON})
+	}
+	for idx, name := range logLevelNames {
+		if strings.EqualFold(level, name) {
+			logOutputFormat, logOutputLevel = format, logLevel(idx)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid log level %q, must be one of %v", level, logLevelNames)
+}
+
+// logEntry a structured log line, fields are key value pairs
+type logEntry struct {
+	time    time.Time
+	level   logLevel
+	message string
+	fields  []interface{}
+}
+
+// logger structured logger, the fields are written with each log line
+type logger struct {
+	fields []interface{}
+}
+
+// defaultLogger logger without fields, for the logs not belong to an admission request
+var defaultLogger = &logger{}
+
+// with create a logger with additional fields
+func (l *logger) with(keysAndValues ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keysAndValues))
+	return &logger{fields: append(append(fields, l.fields...), keysAndValues...)}
+}
+
+func (l *logger) debug(message string, keysAndValues ...interface{}) {
+	l.log(logLevelDebug, message, keysAndValues)
+}
+
+func (l *logger) info(message string, keysAndValues ...interface{}) {
+	l.log(logLevelInfo, message, keysAndValues)
+}
+
+func (l *logger) warning(message string, keysAndValues ...interface{}) {
+	l.log(logLevelWarning, message, keysAndValues)
+}
+
+func (l *logger) error(message string, keysAndValues ...interface{}) {
+	l.log(logLevelError, message, keysAndValues)
+}
+
+// fatal write the error log and exit the program
+func (l *logger) fatal(message string, keysAndValues ...interface{}) {
+	l.log(logLevelError, message, keysAndValues)
+	klog.Flush()
+	os.Exit(1)
+}
+
+// log write the log entry immediately, it must be called directly by the logging methods,
+// so the caller of them is reported by klog
+func (l *logger) log(level logLevel, message string, keysAndValues []interface{}) {
+	if level < logOutputLevel {
+		return
+	}
+
+	fields := make([]interface{}, 0, len(l.fields)+len(keysAndValues))
+	writeLogEntry(logEntry{
+		time:    time.Now(),
+		level:   level,
+		message: message,
+		fields:  append(append(fields, l.fields...), keysAndValues...),
+	})
+}
+
+// the call depth from writeLogEntry to the caller of the logging methods
+const logCallDepth = 3
+
+// writeLogEntry write the log entry in the log format
+func writeLogEntry(entry logEntry) {
+	if logOutputFormat == logFormatJSON {
+		line := formatJSONLogEntry(entry)
+		logOutputLock.Lock()
+		defer logOutputLock.Unlock()
+		_, _ = logOutput.Write(line)
+		return
+	}
+
+	switch entry.level {
+	case logLevelError:
+		klog.ErrorSDepth(logCallDepth, nil, entry.message, entry.fields...)
+	case logLevelWarning:
+		// klog has no structured warning, format it the same as InfoS
+		klog.WarningDepth(logCallDepth, formatTextLogEntry(entry))
+	default:
+		klog.InfoSDepth(logCallDepth, entry.message, entry.fields...)
+	}
+}
+
+// formatTextLogEntry format the log entry as klog structured logs, the quoted message followed by key=value pairs
+func formatTextLogEntry(entry logEntry) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%q", entry.message)
+	for idx := 0; idx < len(entry.fields); idx += 2 {
+		key, value := logField(entry.fields, idx)
+		switch v := value.(type) {
+		case string:
+			fmt.Fprintf(&buf, " %s=%q", key, v)
+		case error:
+			fmt.Fprintf(&buf, " %s=%q", key, v.Error())
+		case fmt.Stringer:
+			fmt.Fprintf(&buf, " %s=%q", key, v.String())
+		default:
+			fmt.Fprintf(&buf, " %s=%+v", key, v)
+		}
+	}
+	return buf.String()
+}
+
+// formatJSONLogEntry format the log entry as JSON object keeping the field order
+func formatJSONLogEntry(entry logEntry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	writeJSONField(&buf, "ts", entry.time.UTC().Format(time.RFC3339Nano), true)
+	writeJSONField(&buf, "level", entry.level.String(), false)
+	writeJSONField(&buf, "msg", entry.message, false)
+	for idx := 0; idx < len(entry.fields); idx += 2 {
+		key, value := logField(entry.fields, idx)
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		writeJSONField(&buf, key, value, false)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func writeJSONField(buf *bytes.Buffer, key string, value interface{}, first bool) {
+	if !first {
+		buf.WriteString(",")
+	}
+	keyJSON, _ := json.Marshal(key)
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		valueJSON, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(keyJSON)
+	buf.WriteString(":")
+	buf.Write(valueJSON)
+}
+
+// logField get the key and value at idx of the key value pairs, value is missing for odd number of fields
+func logField(fields []interface{}, idx int) (string, interface{}) {
+	key := fmt.Sprint(fields[idx])
+	if idx+1 >= len(fields) {
+		return key, "(MISSING)"
+	}
+	return key, fields[idx+1]
+}
+
+// admissionLogger write the logs of an admission request with the request fields, and the decision in the last
+// log line when the request handled, so all the logs of an admission can be joined by the request uid
+type admissionLogger struct {
+	*logger
+	outcome    string
+	skipReason string
+	mode       string // policy mode of the request, empty if enforced
+	dryRun     bool   // the request is a dry run, the object is not persisted
+}
+
+// newAdmissionLogger create admissionLogger with fields of the admission request
+func newAdmissionLogger(admissionRequest *admissionv1.AdmissionRequest) *admissionLogger {
+	l := &admissionLogger{dryRun: isDryRun(admissionRequest)}
+	l.logger = &logger{
+		fields: []interface{}{
+			"uid", string(admissionRequest.UID),
+			"kind", admissionRequest.Kind.Kind,
+			"namespace", admissionRequest.Namespace,
+			"name", admissionRequest.Name,
+			"operation", string(admissionRequest.Operation),
+		},
+	}
+	if l.dryRun {
+		l.logger.fields = append(l.logger.fields, "dryRun", true)
+	}
+	return l
+}
+
+// decide record the outcome of the admission request, and the reason if skipped
+func (l *admissionLogger) decide(outcome, skipReason string) {
+	l.outcome, l.skipReason = outcome, skipReason
+}
+
+// audit mark the decision is recorded only, not applied to the object
+func (l *admissionLogger) audit() {
+	l.mode = policyModeAudit
+}
+
+// record count the admission request by the decision, the dry runs are counted separately
+func (l *admissionLogger) record(namespace string) {
+	if l.dryRun {
+		recordDryRun(l.outcome)
+		return
+	}
+	if l.mode == policyModeAudit && l.outcome != outcomeDecodeError {
+		recordAudit(namespace, l.outcome)
+		return
+	}
+	recordAdmission(namespace, l.outcome, l.skipReason)
+}
+
+// decided write the decision of the admission request, the outcome is empty if the handler panicked
+func (l *admissionLogger) decided() {
+	decision := []interface{}{"decision", l.outcome}
+	if l.skipReason != "" {
+		decision = append(decision, "reason", l.skipReason)
+	}
+	if l.mode != "" {
+		decision = append(decision, "mode", l.mode)
+	}
+	l.log(logLevelInfo, "Admission decided", decision)
+}
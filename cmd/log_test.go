@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestSetupLogging(t *testing.T) {
+	defer func() { logOutputFormat, logOutputLevel = logFormatText, logLevelInfo }()
+
+	testCases := []struct {
+		name   string
+		format string
+		level  string
+		valid  bool
+	}{
+		{"test with text format", logFormatText, "info", true},
+		{"test with json format", logFormatJSON, "WARNING", true},
+		{"test with invalid format", "xml", "info", false},
+		{"test with invalid level", logFormatJSON, "fatal", false},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+		err := setupLogging(testCase.format, testCase.level)
+		assert.Equal(t, err == nil, testCase.valid)
+	}
+}
+
+func TestFormatLogEntry(t *testing.T) {
+	entry := logEntry{
+		level:   logLevelWarning,
+		message: "Skipping mutation",
+		fields:  []interface{}{"uid", "1234", "error", errors.New("invalid files"), "required", false, "odd"},
+	}
+
+	assert.Equal(t, formatTextLogEntry(entry), `"Skipping mutation" uid="1234" error="invalid files" required=false odd="(MISSING)"`)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(formatJSONLogEntry(entry), &line); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, line["level"], "warning")
+	assert.Equal(t, line["msg"], "Skipping mutation")
+	assert.Equal(t, line["error"], "invalid files")
+	assert.Equal(t, line["required"], false)
+}
+
+func TestWebhookServerMutateLogs(t *testing.T) {
+	var output bytes.Buffer
+	stderr := logOutput
+	logOutputFormat, logOutput = logFormatJSON, &output
+	defer func() { logOutputFormat, logOutput = logFormatText, stderr }()
+
+	whsvr := NewWebhookServer()
+	whsvr.mutate(GetAdmissionReviewExample())
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, line["uid"], "3c00fd3b-a64b-4120-9b75-1d49ddb95774")
+		assert.Equal(t, line["namespace"], "demo2")
+		assert.Equal(t, line["operation"], "CREATE")
+		lines = append(lines, line)
+	}
+	// the logs are written immediately, the decision is in the last line
+	assert.Assert(t, len(lines) > 1)
+	assert.Equal(t, lines[0]["decision"], nil)
+	assert.Equal(t, lines[len(lines)-1]["msg"], "Admission decided")
+	assert.Equal(t, lines[len(lines)-1]["decision"], admissionWebhookSuccessFlag)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// the LxcfsPolicy custom resources, see deploy/lxcfspolicy-crd.yaml
+const (
+	lxcfsPolicyKind        = "LxcfsPolicy"        // namespaced, apply to the pods in its namespace
+	clusterLxcfsPolicyKind = "ClusterLxcfsPolicy" // cluster-scoped, apply to the pods in the namespaces selected
+)
+
+var (
+	lxcfsPolicyResource = schema.GroupVersionResource{
+		Group:    "lxcfs-admission-webhook.io",
+		Version:  "v1alpha1",
+		Resource: "lxcfspolicies",
+	}
+	clusterLxcfsPolicyResource = schema.GroupVersionResource{
+		Group:    "lxcfs-admission-webhook.io",
+		Version:  "v1alpha1",
+		Resource: "clusterlxcfspolicies",
+	}
+)
+
+// the annotation records the LxcfsPolicy applied to the pod
+const admissionWebhookAnnotationPolicyKey = "mutating.lxcfs-admission-webhook.io/policy"
+
+// lxcfsPolicy the LxcfsPolicy or ClusterLxcfsPolicy custom resource
+type lxcfsPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              lxcfsPolicySpec `json:"spec"`
+}
+
+// lxcfsPolicySpec the mutation rules of the selected pods, the same as the pod annotations,
+// which take precedence over the policy
+type lxcfsPolicySpec struct {
+	PodSelector       *metav1.LabelSelector `json:"podSelector,omitempty"`       // nil selects all pods
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"` // ClusterLxcfsPolicy only, nil selects all namespaces
+	Enabled           *bool                 `json:"enabled,omitempty"`
+	InitContainers    *bool                 `json:"initContainers,omitempty"`
+	IncludeContainers []string              `json:"includeContainers,omitempty"`
+	ExcludeContainers []string              `json:"excludeContainers,omitempty"`
+	Profile           string                `json:"profile,omitempty"`
+	Files             []string              `json:"files,omitempty"`
+	ConflictStrategy  string                `json:"conflictStrategy,omitempty"`
+}
+
+// policyName the name recorded in the policy annotation, Kind/name for ClusterLxcfsPolicy and Kind/namespace/name for LxcfsPolicy
+func (p *lxcfsPolicy) policyName() string {
+	if p.Namespace == "" {
+		return clusterLxcfsPolicyKind + "/" + p.Name
+	}
+	return lxcfsPolicyKind + "/" + p.Namespace + "/" + p.Name
+}
+
+// annotations convert the policy to the default pod annotations
+func (p *lxcfsPolicy) annotations() map[string]string {
+	annotations := make(map[string]string)
+	if p.Spec.Enabled != nil {
+		annotations[admissionWebhookAnnotationEnableKey] = strconv.FormatBool(*p.Spec.Enabled)
+	}
+	if p.Spec.InitContainers != nil {
+		annotations[admissionWebhookAnnotationInitContainersKey] = strconv.FormatBool(*p.Spec.InitContainers)
+	}
+	if len(p.Spec.IncludeContainers) > 0 {
+		annotations[admissionWebhookAnnotationIncludeContainersKey] = strings.Join(p.Spec.IncludeContainers, ",")
+	}
+	if len(p.Spec.ExcludeContainers) > 0 {
+		annotations[admissionWebhookAnnotationExcludeContainersKey] = strings.Join(p.Spec.ExcludeContainers, ",")
+	}
+	if p.Spec.Profile != "" {
+		annotations[admissionWebhookAnnotationProfileKey] = p.Spec.Profile
+	}
+	if len(p.Spec.Files) > 0 {
+		annotations[admissionWebhookAnnotationFilesKey] = strings.Join(p.Spec.Files, ",")
+	}
+	if p.Spec.ConflictStrategy != "" {
+		annotations[admissionWebhookAnnotationConflictStrategyKey] = p.Spec.ConflictStrategy
+	}
+	return annotations
+}
+
+// selects check whether the policy selects the pod, namespace is nil if unknown
+func (p *lxcfsPolicy) selects(namespace *corev1.Namespace, podLabels map[string]string) (bool, error) {
+	if p.Namespace == "" {
+		if p.Spec.NamespaceSelector != nil && namespace == nil {
+			return false, nil
+		}
+		if namespace != nil {
+			if matched, err := selectorMatches(p.Spec.NamespaceSelector, namespace.Labels); err != nil || !matched {
+				return false, err
+			}
+		}
+	}
+	return selectorMatches(p.Spec.PodSelector, podLabels)
+}
+
+// selectorMatches check whether the label selector matches the labels, nil selector matches all
+func selectorMatches(labelSelector *metav1.LabelSelector, objectLabels map[string]string) (bool, error) {
+	if labelSelector == nil {
+		return true, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(labels.Set(objectLabels)), nil
+}
+
+// selectorRequirements the number of requirements of the label selector, more requirements are more specific
+func selectorRequirements(labelSelector *metav1.LabelSelector) int {
+	if labelSelector == nil {
+		return 0
+	}
+	return len(labelSelector.MatchLabels) + len(labelSelector.MatchExpressions)
+}
+
+// bestLxcfsPolicy choose the policy best matching the pod, nil if no policy selects the pod.
+// The LxcfsPolicy in the pod namespace takes precedence over ClusterLxcfsPolicy,
+// then the policy with more selector requirements, then the first by name.
+func bestLxcfsPolicy(log *logger, policies []*lxcfsPolicy, namespace *corev1.Namespace, podLabels map[string]string) *lxcfsPolicy {
+	var matched []*lxcfsPolicy
+	for _, p := range policies {
+		selected, err := p.selects(namespace, podLabels)
+		if err != nil {
+			log.warning("Ignore LxcfsPolicy with invalid selector", "policy", p.policyName(), "error", err)
+			continue
+		}
+		if selected {
+			matched = append(matched, p)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		pi, pj := matched[i], matched[j]
+		if (pi.Namespace != "") != (pj.Namespace != "") {
+			return pi.Namespace != ""
+		}
+		ri := selectorRequirements(pi.Spec.PodSelector) + selectorRequirements(pi.Spec.NamespaceSelector)
+		rj := selectorRequirements(pj.Spec.PodSelector) + selectorRequirements(pj.Spec.NamespaceSelector)
+		if ri != rj {
+			return ri > rj
+		}
+		return pi.Name < pj.Name
+	})
+	return matched[0]
+}
+
+// lxcfsPolicyWatcher cache the LxcfsPolicy, ClusterLxcfsPolicy and namespaces by informers
+type lxcfsPolicyWatcher struct {
+	factory          dynamicinformer.DynamicSharedInformerFactory
+	namespaceFactory informers.SharedInformerFactory
+	policies         cache.GenericLister
+	clusterPolicies  cache.GenericLister
+	namespaces       corelisters.NamespaceLister
+	synced           []cache.InformerSynced
+}
+
+// dynamicClient create dynamic client from the kubeconfig file, in-cluster config is used if kubeconfig is empty
+func dynamicClient(kubeconfig string) (dynamic.Interface, error) {
+	config, err := kubernetesConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
+
+// newLxcfsPolicyWatcher create lxcfsPolicyWatcher, the namespaces are cached by the informer factory
+// shared by the watchers, the cache is filled after run
+func newLxcfsPolicyWatcher(client dynamic.Interface, namespaceFactory informers.SharedInformerFactory) *lxcfsPolicyWatcher {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	policies := factory.ForResource(lxcfsPolicyResource)
+	clusterPolicies := factory.ForResource(clusterLxcfsPolicyResource)
+	namespaces := namespaceFactory.Core().V1().Namespaces()
+
+	return &lxcfsPolicyWatcher{
+		factory:          factory,
+		namespaceFactory: namespaceFactory,
+		policies:         policies.Lister(),
+		clusterPolicies:  clusterPolicies.Lister(),
+		namespaces:       namespaces.Lister(),
+		synced: []cache.InformerSynced{
+			policies.Informer().HasSynced,
+			clusterPolicies.Informer().HasSynced,
+			namespaces.Informer().HasSynced,
+		},
+	}
+}
+
+// run watch the policies until stopCh closed
+func (w *lxcfsPolicyWatcher) run(stopCh <-chan struct{}) {
+	w.factory.Start(stopCh)
+	w.namespaceFactory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, w.synced...) {
+		defaultLogger.error("Failed to sync LxcfsPolicy cache")
+		return
+	}
+	defaultLogger.info("LxcfsPolicy cache synced")
+}
+
+// hasSynced check whether the policies and namespaces are cached
+func (w *lxcfsPolicyWatcher) hasSynced() bool {
+	for _, synced := range w.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+// match get the policy best matching the pod, nil if no policy matched or the cache not synced
+func (w *lxcfsPolicyWatcher) match(log *logger, namespace string, podLabels map[string]string) *lxcfsPolicy {
+	if w == nil || !w.hasSynced() {
+		return nil
+	}
+
+	var policies []*lxcfsPolicy
+	namespaced, err := w.policies.ByNamespace(namespace).List(labels.Everything())
+	if err != nil {
+		log.error("Failed to list LxcfsPolicy", "error", err)
+	}
+	cluster, err := w.clusterPolicies.List(labels.Everything())
+	if err != nil {
+		log.error("Failed to list ClusterLxcfsPolicy", "error", err)
+	}
+	for _, obj := range append(namespaced, cluster...) {
+		p, err := toLxcfsPolicy(obj)
+		if err != nil {
+			log.warning("Ignore invalid LxcfsPolicy", "error", err)
+			continue
+		}
+		policies = append(policies, p)
+	}
+
+	ns, err := w.namespaces.Get(namespace)
+	if err != nil {
+		ns = nil
+	}
+	return bestLxcfsPolicy(log, policies, ns, podLabels)
+}
+
+// toLxcfsPolicy convert the object cached by dynamic informer to lxcfsPolicy
+func toLxcfsPolicy(obj runtime.Object) (*lxcfsPolicy, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object type %T", obj)
+	}
+	var p lxcfsPolicy
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &p); err != nil {
+		return nil, fmt.Errorf("invalid %s %s: %v", u.GetKind(), u.GetName(), err)
+	}
+	return &p, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newLxcfsPolicyExample(namespace, name string, podSelector, namespaceSelector map[string]string, spec lxcfsPolicySpec) *lxcfsPolicy {
+	kind := clusterLxcfsPolicyKind
+	if namespace != "" {
+		kind = lxcfsPolicyKind
+	}
+	if podSelector != nil {
+		spec.PodSelector = &metav1.LabelSelector{MatchLabels: podSelector}
+	}
+	if namespaceSelector != nil {
+		spec.NamespaceSelector = &metav1.LabelSelector{MatchLabels: namespaceSelector}
+	}
+	return &lxcfsPolicy{
+		TypeMeta:   metav1.TypeMeta{APIVersion: lxcfsPolicyResource.GroupVersion().String(), Kind: kind},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       spec,
+	}
+}
+
+func TestBestLxcfsPolicy(t *testing.T) {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "demo", Labels: map[string]string{"tenant": "a"}}}
+	podLabels := map[string]string{"app": "nginx", "tier": "web"}
+
+	all := newLxcfsPolicyExample("", "all", nil, nil, lxcfsPolicySpec{})
+	tenant := newLxcfsPolicyExample("", "tenant", nil, map[string]string{"tenant": "a"}, lxcfsPolicySpec{})
+	otherTenant := newLxcfsPolicyExample("", "other-tenant", nil, map[string]string{"tenant": "b"}, lxcfsPolicySpec{})
+	namespaced := newLxcfsPolicyExample("demo", "namespaced", nil, nil, lxcfsPolicySpec{})
+	nginx := newLxcfsPolicyExample("demo", "nginx", map[string]string{"app": "nginx"}, nil, lxcfsPolicySpec{})
+	web := newLxcfsPolicyExample("demo", "web", map[string]string{"app": "nginx", "tier": "web"}, nil, lxcfsPolicySpec{})
+	invalid := newLxcfsPolicyExample("demo", "invalid", nil, nil, lxcfsPolicySpec{
+		PodSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: "Unknown"}}},
+	})
+
+	testCases := []struct {
+		name      string
+		policies  []*lxcfsPolicy
+		namespace *corev1.Namespace
+		except    *lxcfsPolicy
+	}{
+		{"test without policy", nil, namespace, nil},
+		{"test with cluster policy", []*lxcfsPolicy{all}, namespace, all},
+		{"test with namespace selector", []*lxcfsPolicy{all, tenant, otherTenant}, namespace, tenant},
+		{"test with namespace unknown", []*lxcfsPolicy{tenant, all}, nil, all},
+		{"test with namespaced policy", []*lxcfsPolicy{tenant, namespaced}, namespace, namespaced},
+		{"test with pod selector", []*lxcfsPolicy{namespaced, web, nginx}, namespace, web},
+		{"test with invalid selector", []*lxcfsPolicy{invalid, all}, namespace, all},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+		assert.Equal(t, bestLxcfsPolicy(defaultLogger, testCase.policies, testCase.namespace, podLabels), testCase.except)
+	}
+}
+
+func TestWebhookServerMutateWithLxcfsPolicy(t *testing.T) {
+	enabled := false
+	var objects []runtime.Object
+	for _, p := range []*lxcfsPolicy{
+		newLxcfsPolicyExample("", "tenant", nil, map[string]string{"tenant": "a"}, lxcfsPolicySpec{Profile: lxcfsProfileMinimal}),
+		newLxcfsPolicyExample("demo2", "cpu", map[string]string{"app": "nginx"}, nil, lxcfsPolicySpec{Profile: lxcfsProfileCPU}),
+		newLxcfsPolicyExample("demo2", "disabled", map[string]string{"app": "redis"}, nil, lxcfsPolicySpec{Enabled: &enabled}),
+	} {
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, &unstructured.Unstructured{Object: content})
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		lxcfsPolicyResource:        lxcfsPolicyKind + "List",
+		clusterLxcfsPolicyResource: clusterLxcfsPolicyKind + "List",
+	}, objects...)
+	client := fake.NewSimpleClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo2", Labels: map[string]string{"tenant": "a"}},
+	})
+
+	// the namespaces are cached once for both watchers
+	factory := informers.NewSharedInformerFactory(client, 0)
+	whsvr := NewWebhookServer()
+	whsvr.namespaces = newNamespaceWatcher(factory)
+	whsvr.policies = newLxcfsPolicyWatcher(dynamicClient, factory)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go whsvr.namespaces.run(stopCh)
+	go whsvr.policies.run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, whsvr.policies.hasSynced, whsvr.namespaces.synced) {
+		t.Fatal("LxcfsPolicy cache not synced")
+	}
+
+	admissionResponse := whsvr.mutate(GetAdmissionReviewExample())
+	assert.Equal(t, admissionResponse.Allowed, true)
+	patch := string(admissionResponse.Patch)
+	assert.Equal(t, strings.Contains(patch, "\"mutating.lxcfs-admission-webhook.io/policy\":\"LxcfsPolicy/demo2/cpu\""), true, patch)
+	assert.Equal(t, strings.Contains(patch, strings.Join(lxcfsProfiles[lxcfsProfileCPU], ",")), true, patch)
+}
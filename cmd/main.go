@@ -5,12 +5,17 @@ import (
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 
-	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
 )
 
 var (
@@ -21,68 +26,254 @@ var (
 )
 
 func versionInfo() {
-	fmt.Printf("Version:\t%s\n", Version)
-	fmt.Printf("Go version:\t%s\n", GoVersion)
-	fmt.Printf("Git commit:\t%s\n", GitCommit)
-	fmt.Printf("Built:\t\t%s\n", BuildTime)
+	info := currentBuildInfo()
+	fmt.Printf("Version:\t%s\n", info.Version)
+	fmt.Printf("Go version:\t%s\n", info.GoVersion)
+	fmt.Printf("Git commit:\t%s\n", info.GitCommit)
+	fmt.Printf("Built:\t\t%s\n", info.BuildTime)
 }
 
-func startWebhookServer(parameters *WhSvrParameters) *WebhookServer {
-	pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
+// newCertificateProvider create the provider of serving certificate, by the key pair files or self-managed
+func newCertificateProvider(parameters *WhSvrParameters) (certificateProvider, error) {
+	if !parameters.selfManagedCert {
+		return newKeyPairReloader(parameters.certFile, parameters.keyFile)
+	}
+
+	client, err := kubernetesClient(parameters.kubeconfig)
 	if err != nil {
-		glog.Errorf("Failed to load key pair: %v", err)
+		return nil, err
+	}
+	return newCertManager(client, parameters.namespace, parameters.certSecret, parameters.serviceName, parameters.webhookConfigName)
+}
+
+// startWebhookServer start the webhook server in new goroutine,
+// return error if the certificate is invalid or the port can't be listened
+func startWebhookServer(parameters *WhSvrParameters) (*WebhookServer, error) {
+	certificate, err := newCertificateProvider(parameters)
+	if err != nil {
+		return nil, err
 	}
 
 	whsvr := &WebhookServer{
 		server: &http.Server{
 			Addr:      fmt.Sprintf(":%v", parameters.port),
-			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
+			TLSConfig: &tls.Config{GetCertificate: certificate.GetCertificate},
 		},
+		certificate: certificate,
+	}
+
+	// the namespaces and nodes are cached once by the informer factory shared by the watchers
+	var client kubernetes.Interface
+	var factory informers.SharedInformerFactory
+	if parameters.namespaceDefaults || parameters.nodeFiles || parameters.lxcfsPolicies || parameters.nodeController {
+		if client, err = kubernetesClient(parameters.kubeconfig); err != nil {
+			return nil, err
+		}
+		factory = informers.NewSharedInformerFactory(client, 0)
+	}
+
+	if parameters.namespaceDefaults {
+		whsvr.namespaces = newNamespaceWatcher(factory)
 	}
 
+	if parameters.nodeFiles {
+		whsvr.nodeFiles = newNodeFilesWatcher(factory)
+	}
+
+	if parameters.lxcfsPolicies {
+		dynamic, err := dynamicClient(parameters.kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		whsvr.policies = newLxcfsPolicyWatcher(dynamic, factory)
+	}
+
+	var controller *nodeController
+	if parameters.nodeController {
+		// the pod name is unique in the webhook replicas
+		identity, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		if controller, err = newNodeController(client, factory, parameters.namespace, parameters.lxcfsPodSelector, identity); err != nil {
+			return nil, err
+		}
+	}
+
+	policy, loaded, err := loadWebhookPolicy(parameters)
+	if err != nil {
+		defaultLogger.error("Failed to load config, use default config", "error", err)
+		policy = defaultPolicy
+	}
+	whsvr.setPolicy(policy)
+	whsvr.recordConfigLoad(err)
+
 	// define http server and server handler
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ping", whsvr.ping)
 	mux.HandleFunc("/mutate", whsvr.serve)
+	mux.Handle("/metrics", promhttp.Handler())
 	whsvr.server.Handler = mux
 
+	// probes and version are served in plain HTTP if probe port set
+	probeMux := mux
+	if parameters.probePort != 0 {
+		probeMux = http.NewServeMux()
+		whsvr.probeServer = &http.Server{
+			Addr:    fmt.Sprintf(":%v", parameters.probePort),
+			Handler: probeMux,
+		}
+	}
+	probeMux.HandleFunc("/healthz", whsvr.healthz)
+	probeMux.HandleFunc("/readyz", whsvr.readyz)
+	probeMux.HandleFunc("/version", whsvr.version)
+
+	// listen before return, so the webhook server is ready to serve once started
+	listener, err := net.Listen("tcp", whsvr.server.Addr)
+	if err != nil {
+		return nil, err
+	}
+	var probeListener net.Listener
+	if whsvr.probeServer != nil {
+		if probeListener, err = net.Listen("tcp", whsvr.probeServer.Addr); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+	}
+
+	// update certificate and reload config file until webhook server shutdown
+	stopCh := make(chan struct{})
+	whsvr.server.RegisterOnShutdown(func() {
+		atomic.StoreInt32(&whsvr.shutdown, 1)
+		close(stopCh)
+	})
+	go certificate.watch(stopCh)
+	if whsvr.namespaces != nil {
+		go whsvr.namespaces.run(stopCh)
+	}
+	if whsvr.policies != nil {
+		go whsvr.policies.run(stopCh)
+	}
+	if whsvr.nodeFiles != nil {
+		go whsvr.nodeFiles.run(stopCh)
+	}
+	if controller != nil {
+		go controller.run(stopCh)
+	}
+	if parameters.configFile != "" {
+		go whsvr.watchConfig(parameters, loaded, stopCh)
+	}
+
 	// start webhook server in new rountine
 	go func() {
-		if err := whsvr.server.ListenAndServeTLS("", ""); err != nil {
-			glog.Errorf("Failed to listen and serve webhook server: %v", err)
+		if err := whsvr.server.ServeTLS(listener, "", ""); err != nil && err != http.ErrServerClosed {
+			defaultLogger.error("Failed to listen and serve webhook server", "error", err)
 		}
 	}()
+	if whsvr.probeServer != nil {
+		go func() {
+			if err := whsvr.probeServer.Serve(probeListener); err != nil && err != http.ErrServerClosed {
+				defaultLogger.error("Failed to listen and serve probe server", "error", err)
+			}
+		}()
+	}
+
+	return whsvr, nil
+}
 
-	return whsvr
+// stopWebhookServer shutdown the webhook server gracefully, then the probe server
+// so the readiness probe fails during shutting down
+func stopWebhookServer(ctx context.Context, whsvr *WebhookServer) error {
+	if err := whsvr.server.Shutdown(ctx); err != nil {
+		return err
+	}
+	if whsvr.probeServer != nil {
+		return whsvr.probeServer.Shutdown(ctx)
+	}
+	return nil
+}
+
+// subcommands the subcommands run on the nodes, the webhook server is started without subcommand
+var subcommands = map[string]func(args []string) error{
+	agentCommand:     runAgent,
+	superviseCommand: runSupervise,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			defer klog.Flush()
+			if err := run(os.Args[2:]); err != nil {
+				defaultLogger.fatal("Subcommand failed", "subcommand", os.Args[1], "error", err)
+			}
+			return
+		}
+	}
+
 	var parameters WhSvrParameters
 	var echoVersion bool
+	var logFormat, logLevel string
 
 	// get command line parameters
 	flag.IntVar(&parameters.port, "port", 8443, "Webhook server port.")
+	flag.IntVar(&parameters.probePort, "probePort", 0, "Plain HTTP port serves /healthz, /readyz and /version, 0 to serve them on -port.")
 	flag.StringVar(&parameters.certFile, "tlsCertFile", "/etc/webhook/certs/tls.crt", "File containing the x509 Certificate for HTTPS.")
 	flag.StringVar(&parameters.keyFile, "tlsKeyFile", "/etc/webhook/certs/tls.key", "File containing the x509 private key to --tlsCertFile.")
+	flag.StringVar(&parameters.mode, "mode", policyModeEnforce, fmt.Sprintf("Policy mode, one of %v, the pods are only annotated with what would be mutated in audit mode.", policyModes))
+	flag.StringVar(&parameters.conflictStrategy, "conflictStrategy", conflictStrategySkipPod, fmt.Sprintf("Default strategy to resolve volume mount conflicts, one of %v.", conflictStrategies))
+	flag.BoolVar(&parameters.mutateWorkloads, "mutateWorkloads", false, "Mutate the pod template of Deployment, StatefulSet, DaemonSet, Job and CronJob.")
+	flag.BoolVar(&parameters.nodeAffinity, "nodeAffinity", false, "Add required node affinity to the mutated pods, schedule them to the nodes labeled by -nodeController only.")
+	flag.StringVar(&parameters.lxcfsVersion, "lxcfsVersion", defaultLxcfsVersion, "LXCFS version in use, the LXCFS files not provided by this version can't be mounted.")
+	flag.StringVar(&parameters.lxcfsHostRoot, "lxcfsHostRoot", defaultLxcfsHostRoot, "Host directory contains the LXCFS mount point, mounted into container at the same path.")
+	flag.StringVar(&parameters.lxcfsMountDir, "lxcfsMountDir", defaultLxcfsMountDir, "Sub directory of -lxcfsHostRoot where LXCFS is mounted.")
+	flag.BoolVar(&parameters.readinessGuard, "readinessGuard", false, "Prepend the init container waits for the LXCFS files ready to the mutated pods.")
+	flag.StringVar(&parameters.readinessGuardImage, "readinessGuardImage", defaultReadinessGuardImage, "Image of the readiness guard init container, provides sh, grep and head.")
+	flag.DurationVar(&parameters.readinessGuardTimeout, "readinessGuardTimeout", defaultReadinessGuardTimeout, "Time the readiness guard waits for the LXCFS files ready.")
+	flag.StringVar(&parameters.readinessGuardFailurePolicy, "readinessGuardFailurePolicy", readinessGuardFailurePolicyFail, fmt.Sprintf("What the readiness guard does when timed out, one of %v, Ignore starts the containers without LXCFS.", readinessGuardFailurePolicies))
+	flag.StringVar(&parameters.configFile, "config", "", "YAML file of the webhook policy, reloaded on change or SIGHUP, override the parameters above.")
+	flag.BoolVar(&parameters.namespaceDefaults, "namespaceDefaults", false, "Watch namespaces, the namespace annotations and labels are the default of the pod annotations in it.")
+	flag.BoolVar(&parameters.lxcfsPolicies, "lxcfsPolicies", false, "Watch LxcfsPolicy and ClusterLxcfsPolicy, the best matching policy is the default of the pod annotations.")
+	flag.BoolVar(&parameters.nodeController, "nodeController", false, fmt.Sprintf("Label the nodes where the LXCFS DaemonSet pod is ready with %s=%s.", lxcfsReadyNodeLabel, lxcfsReadyNodeLabelValue))
+	flag.BoolVar(&parameters.nodeFiles, "nodeFiles", false, fmt.Sprintf("Watch the LXCFS files published by the node agent, the default profile is %q, the files supported by all the nodes selected by the pod's node selector.", lxcfsProfileSupported))
+	flag.StringVar(&parameters.lxcfsPodSelector, "lxcfsPodSelector", defaultLxcfsPodSelector, "Label selector of the LXCFS DaemonSet pods in -namespace.")
+	flag.BoolVar(&parameters.selfManagedCert, "selfManagedCert", false, "Generate the CA and certificate in secret -certSecret and patch caBundle of -webhookConfigName, instead of --tlsCertFile and --tlsKeyFile.")
+	flag.StringVar(&parameters.kubeconfig, "kubeconfig", "", "Path to kubeconfig, in-cluster config is used if empty.")
+	flag.StringVar(&parameters.namespace, "namespace", "lxcfs", "Namespace of the webhook service, the certificate secret and the LXCFS DaemonSet.")
+	flag.StringVar(&parameters.serviceName, "serviceName", "lxcfs-admission-webhook", "Webhook service name, the certificate is valid for its DNS names.")
+	flag.StringVar(&parameters.certSecret, "certSecret", "lxcfs-admission-webhook", "Secret name stores the self-managed certificate.")
+	flag.StringVar(&parameters.webhookConfigName, "webhookConfigName", "lxcfs-admission-webhook", "MutatingWebhookConfiguration name to patch caBundle.")
+	flag.StringVar(&logFormat, "logFormat", logFormatText, fmt.Sprintf("Log format, one of %v, the klog flags take effect for text format only.", []string{logFormatText, logFormatJSON}))
+	flag.StringVar(&logLevel, "logLevel", logLevelInfo.String(), fmt.Sprintf("Minimum level of the logs to write, one of %v.", logLevelNames))
 	flag.BoolVar(&echoVersion, "version", false, "Show the LXCFS admission webhook version information")
 	flag.Parse()
 
-	defer glog.Flush()
+	defer klog.Flush()
 
 	if echoVersion {
 		versionInfo()
 		os.Exit(0)
 	}
 
-	whsvr := startWebhookServer(&parameters)
+	if err := setupLogging(logFormat, logLevel); err != nil {
+		klog.Exitf("Invalid logging flags: %v", err)
+	}
+
+	if _, _, err := loadWebhookPolicy(&parameters); err != nil {
+		defaultLogger.fatal("Invalid config", "error", err)
+	}
+
+	whsvr, err := startWebhookServer(&parameters)
+	if err != nil {
+		defaultLogger.fatal("Failed to start webhook server", "error", err)
+	}
 
 	// listening OS shutdown singal
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	<-signalChan
 
-	glog.Infof("Got OS shutdown signal, shutting down webhook server gracefully...")
-	if err := whsvr.server.Shutdown(context.Background()); err != nil {
-		glog.Errorf("Errors when shutting service: %v", err)
+	defaultLogger.info("Got OS shutdown signal, shutting down webhook server gracefully")
+	if err := stopWebhookServer(context.Background(), whsvr); err != nil {
+		defaultLogger.error("Errors when shutting service", "error", err)
 	}
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/x509"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "lxcfs_admission_webhook"
+
+// admission outcomes, besides the status annotation flags
+const outcomeDecodeError = "decode-error"
+
+// the reasons of skipping mutation
+const (
+	skipReasonPolicy            = "policy"
+	skipReasonAlreadyMutated    = "already-mutated"
+	skipReasonWorkloadsDisabled = "workloads-disabled"
+	skipReasonNoContainer       = "no-container"
+	skipReasonInvalidFiles      = "invalid-files"
+	skipReasonInvalidStrategy   = "invalid-conflict-strategy"
+)
+
+var (
+	admissionOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_outcomes_total",
+		Help:      "Number of admission requests by outcome, one of mutated, skip, conflict, audit and decode-error.",
+	}, []string{"outcome"})
+
+	admissionSkips = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_skips_total",
+		Help:      "Number of admission requests skipped mutation by namespace and reason.",
+	}, []string{"namespace", "reason"})
+
+	auditDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audit_decisions_total",
+		Help:      "Number of admission requests in audit mode by namespace and the decision would be made.",
+	}, []string{"namespace", "decision"})
+
+	dryRunAdmissions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dry_run_admissions_total",
+		Help:      "Number of dry run admission requests by outcome, not counted by the other admission metrics.",
+	}, []string{"outcome"})
+
+	serveDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "serve_duration_seconds",
+		Help:      "Latency of serving admission requests.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	patchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "patch_size_bytes",
+		Help:      "Size of the JSON patch in admission responses.",
+		Buckets:   prometheus.ExponentialBuckets(64, 2, 10),
+	})
+
+	certificateExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "tls_certificate_expiry_timestamp_seconds",
+		Help:      "Expiry time of the serving TLS certificate in unix seconds.",
+	})
+
+	configLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last config file load succeeded, 1 for succeeded, the last good config is kept otherwise.",
+	})
+)
+
+// the metrics of the node agent, served by the agent watching LXCFS instead of the webhook
+var (
+	agentRegistry = prometheus.NewRegistry()
+
+	agentLxcfsMounted = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "agent_lxcfs_mounted",
+		Help:      "Whether LXCFS is mounted and connected on the node, 1 for mounted.",
+	}, []string{"node"})
+
+	agentBrokenContainers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "agent_broken_containers",
+		Help:      "Number of containers with the LXCFS files lost FUSE connection on the node in the last check.",
+	}, []string{"node"})
+
+	agentStrayContainers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "agent_stray_containers",
+		Help:      "Number of containers with the LXCFS files mounted from the stray directories created before LXCFS mounted on the node in the last check.",
+	}, []string{"node"})
+
+	agentRepairedContainers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "agent_repaired_containers_total",
+		Help:      "Number of containers with the LXCFS files remounted on the node.",
+	}, []string{"node"})
+)
+
+func init() {
+	prometheus.MustRegister(admissionOutcomes, admissionSkips, auditDecisions, dryRunAdmissions, serveDuration, patchSize, certificateExpiry,
+		configLastReloadSuccessful)
+	agentRegistry.MustRegister(agentLxcfsMounted, agentBrokenContainers, agentStrayContainers, agentRepairedContainers)
+}
+
+// recordAdmission count the admission request by outcome, and by namespace and reason if skipped
+func recordAdmission(namespace, outcome, skipReason string) {
+	admissionOutcomes.WithLabelValues(outcome).Inc()
+	if outcome == admissionWebhookSkipFlag {
+		admissionSkips.WithLabelValues(namespace, skipReason).Inc()
+	}
+}
+
+// recordAudit count the admission request in audit mode by namespace and the decision would be made
+func recordAudit(namespace, decision string) {
+	admissionOutcomes.WithLabelValues(outcomeAudit).Inc()
+	auditDecisions.WithLabelValues(namespace, decision).Inc()
+}
+
+// recordDryRun count the dry run admission request by outcome
+func recordDryRun(outcome string) {
+	dryRunAdmissions.WithLabelValues(outcome).Inc()
+}
+
+// recordLxcfsMounted record whether LXCFS is mounted on the node
+func recordLxcfsMounted(node string, mounted bool) {
+	value := 0.0
+	if mounted {
+		value = 1
+	}
+	agentLxcfsMounted.WithLabelValues(node).Set(value)
+}
+
+// recordWatchdogCheck record the number of containers broken, repaired and with stray files on the node by a watchdog check
+func recordWatchdogCheck(node string, broken, repaired, stray int) {
+	agentBrokenContainers.WithLabelValues(node).Set(float64(broken))
+	agentStrayContainers.WithLabelValues(node).Set(float64(stray))
+	agentRepairedContainers.WithLabelValues(node).Add(float64(repaired))
+}
+
+// recordConfigReload record whether the last config file load succeeded
+func recordConfigReload(successful bool) {
+	value := 0.0
+	if successful {
+		value = 1
+	}
+	configLastReloadSuccessful.Set(value)
+}
+
+// recordCertificate record the expiry time of serving certificate
+func recordCertificate(leaf *x509.Certificate) {
+	certificateExpiry.Set(float64(leaf.NotAfter.Unix()))
+}
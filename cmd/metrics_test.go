@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"gotest.tools/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// histogramCount the number of the observations of the histogram
+func histogramCount(t *testing.T, histogram prometheus.Histogram) uint64 {
+	var metric dto.Metric
+	if err := histogram.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+// serveAdmissionReview post the admission review to the webhook server, return the response
+func serveAdmissionReview(t *testing.T, whsvr *WebhookServer, ar *admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+	body, _ := json.Marshal(ar)
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	whsvr.serve(rr, req)
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(rr.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+	return review.Response
+}
+
+func TestWebhookServerMetrics(t *testing.T) {
+	whsvr := NewWebhookServer()
+
+	disabled := GetAdmissionReviewExample()
+	var pod corev1.Pod
+	if err := json.Unmarshal(disabled.Request.Object.Raw, &pod); err != nil {
+		t.Error(err)
+	}
+	pod.SetAnnotations(map[string]string{admissionWebhookAnnotationEnableKey: "false"})
+	disabled.Request.Object.Raw, _ = json.Marshal(pod)
+
+	testCases := []struct {
+		name    string
+		body    interface{}
+		outcome string
+		skipped bool
+	}{
+		{"test with mutated pod", GetAdmissionReviewExample(), admissionWebhookSuccessFlag, false},
+		{"test with disabled pod", disabled, admissionWebhookSkipFlag, true},
+		{"test with invalid body", []string{"invalid"}, outcomeDecodeError, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+
+		outcomes := testutil.ToFloat64(admissionOutcomes.WithLabelValues(testCase.outcome))
+		skips := testutil.ToFloat64(admissionSkips.WithLabelValues("demo2", skipReasonPolicy))
+
+		body, _ := json.Marshal(testCase.body)
+		req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		whsvr.serve(httptest.NewRecorder(), req)
+
+		assert.Equal(t, testutil.ToFloat64(admissionOutcomes.WithLabelValues(testCase.outcome)), outcomes+1)
+		if testCase.skipped {
+			assert.Equal(t, testutil.ToFloat64(admissionSkips.WithLabelValues("demo2", skipReasonPolicy)), skips+1)
+		}
+	}
+}
+
+func TestWebhookServerDryRunMetrics(t *testing.T) {
+	var output bytes.Buffer
+	stderr := logOutput
+	logOutputFormat, logOutput = logFormatJSON, &output
+	defer func() { logOutputFormat, logOutput = logFormatText, stderr }()
+
+	whsvr := NewWebhookServer()
+	ar := GetAdmissionReviewExample()
+	dryRun := true
+	ar.Request.DryRun = &dryRun
+
+	outcomes := testutil.ToFloat64(admissionOutcomes.WithLabelValues(admissionWebhookSuccessFlag))
+	dryRuns := testutil.ToFloat64(dryRunAdmissions.WithLabelValues(admissionWebhookSuccessFlag))
+	serves, patches := histogramCount(t, serveDuration), histogramCount(t, patchSize)
+
+	// the patch is returned to show the mutation, but not counted as a real admission
+	admissionResponse := serveAdmissionReview(t, whsvr, ar)
+	assert.Equal(t, admissionResponse.Allowed, true)
+	assert.Equal(t, len(admissionResponse.Patch) > 0, true)
+	assert.Equal(t, testutil.ToFloat64(admissionOutcomes.WithLabelValues(admissionWebhookSuccessFlag)), outcomes)
+	assert.Equal(t, testutil.ToFloat64(dryRunAdmissions.WithLabelValues(admissionWebhookSuccessFlag)), dryRuns+1)
+	assert.Equal(t, histogramCount(t, serveDuration), serves)
+	assert.Equal(t, histogramCount(t, patchSize), patches)
+
+	var line map[string]interface{}
+	if err := json.NewDecoder(&output).Decode(&line); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, line["dryRun"], true)
+
+	// the same request without dry run is observed
+	serveAdmissionReview(t, whsvr, GetAdmissionReviewExample())
+	assert.Equal(t, histogramCount(t, serveDuration), serves+1)
+	assert.Equal(t, histogramCount(t, patchSize), patches+1)
+}
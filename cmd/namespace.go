@@ -0,0 +1,102 @@
+package main
+
+import (
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// the pod annotations can be defaulted by the namespace annotations and LxcfsPolicy,
+// the annotations set on pod take precedence
+var defaultableAnnotationKeys = []string{
+	admissionWebhookAnnotationEnableKey,
+	admissionWebhookAnnotationInitContainersKey,
+	admissionWebhookAnnotationIncludeContainersKey,
+	admissionWebhookAnnotationExcludeContainersKey,
+	admissionWebhookAnnotationProfileKey,
+	admissionWebhookAnnotationFilesKey,
+	admissionWebhookAnnotationConflictStrategyKey,
+}
+
+// namespaceWatcher cache the namespaces by informer, provide the default annotations of the pods in them
+type namespaceWatcher struct {
+	factory informers.SharedInformerFactory
+	lister  corelisters.NamespaceLister
+	synced  cache.InformerSynced
+}
+
+// newNamespaceWatcher create namespaceWatcher by the informer factory shared by the watchers,
+// the cache is filled after run
+func newNamespaceWatcher(factory informers.SharedInformerFactory) *namespaceWatcher {
+	informer := factory.Core().V1().Namespaces()
+	return &namespaceWatcher{
+		factory: factory,
+		lister:  informer.Lister(),
+		synced:  informer.Informer().HasSynced,
+	}
+}
+
+// run watch the namespaces until stopCh closed, the shared informers started already are not started again
+func (w *namespaceWatcher) run(stopCh <-chan struct{}) {
+	w.factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, w.synced) {
+		defaultLogger.error("Failed to sync namespaces cache")
+		return
+	}
+	defaultLogger.info("Namespaces cache synced")
+}
+
+// defaults get the annotations of namespace with the labels of the same keys, the annotations take precedence.
+// The label values can't hold the file paths or the comma separated lists, the labels set the other keys only.
+// Nil if the namespace not found or the cache not synced.
+func (w *namespaceWatcher) defaults(name string) map[string]string {
+	if w == nil || !w.synced() {
+		return nil
+	}
+	namespace, err := w.lister.Get(name)
+	if err != nil {
+		return nil
+	}
+	if len(namespace.Labels) == 0 {
+		return namespace.Annotations
+	}
+
+	defaults := make(map[string]string, len(namespace.Labels)+len(namespace.Annotations))
+	for key, value := range namespace.Labels {
+		defaults[key] = value
+	}
+	for key, value := range namespace.Annotations {
+		defaults[key] = value
+	}
+	return defaults
+}
+
+// annotationDefaults fill the pod annotations not set by the defaults, e.g. the namespace annotations,
+// both are imported by the policy, the pod annotations are not modified
+func annotationDefaults(podAnnotations, defaults map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return podAnnotations
+	}
+
+	annotations := make(map[string]string, len(podAnnotations)+len(defaultableAnnotationKeys))
+	for _, key := range defaultableAnnotationKeys {
+		if value, ok := defaults[key]; ok {
+			annotations[key] = value
+		}
+	}
+	if len(annotations) == 0 {
+		return podAnnotations
+	}
+	// the pod explicitly lists the files, the default profile doesn't apply
+	if _, ok := podAnnotations[admissionWebhookAnnotationFilesKey]; ok {
+		delete(annotations, admissionWebhookAnnotationProfileKey)
+	}
+	// the pod chooses a profile, the default files don't apply
+	if _, ok := podAnnotations[admissionWebhookAnnotationProfileKey]; ok {
+		delete(annotations, admissionWebhookAnnotationFilesKey)
+	}
+	for key, value := range podAnnotations {
+		annotations[key] = value
+	}
+	return annotations
+}
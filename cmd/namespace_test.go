@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestAnnotationDefaults(t *testing.T) {
+	testCases := []struct {
+		name      string
+		pod       map[string]string
+		namespace map[string]string
+		except    map[string]string
+	}{
+		{"test without namespace annotations", map[string]string{"app": "nginx"}, nil, map[string]string{"app": "nginx"}},
+		{"test with namespace enable", nil,
+			map[string]string{admissionWebhookAnnotationEnableKey: "false", "team": "demo"},
+			map[string]string{admissionWebhookAnnotationEnableKey: "false"}},
+		{"test with pod override", map[string]string{admissionWebhookAnnotationEnableKey: "true"},
+			map[string]string{admissionWebhookAnnotationEnableKey: "false", admissionWebhookAnnotationProfileKey: lxcfsProfileCPU},
+			map[string]string{admissionWebhookAnnotationEnableKey: "true", admissionWebhookAnnotationProfileKey: lxcfsProfileCPU}},
+		{"test with pod files override namespace profile", map[string]string{admissionWebhookAnnotationFilesKey: "/proc/uptime"},
+			map[string]string{admissionWebhookAnnotationProfileKey: lxcfsProfileCPU},
+			map[string]string{admissionWebhookAnnotationFilesKey: "/proc/uptime"}},
+		{"test with status not defaulted", nil,
+			map[string]string{admissionWebhookAnnotationStatusKey: admissionWebhookSuccessFlag},
+			nil},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+		assert.DeepEqual(t, annotationDefaults(testCase.pod, testCase.namespace), testCase.except)
+	}
+}
+
+func TestWebhookServerMutateWithNamespaceDefaults(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "demo2",
+			Annotations: map[string]string{
+				admissionWebhookAnnotationProfileKey:           lxcfsProfileMinimal,
+				admissionWebhookAnnotationExcludeContainersKey: "sidecar",
+			},
+		},
+	})
+
+	whsvr := NewWebhookServer()
+	whsvr.namespaces = newNamespaceWatcher(informers.NewSharedInformerFactory(client, 0))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go whsvr.namespaces.run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, whsvr.namespaces.synced) {
+		t.Fatal("namespaces cache not synced")
+	}
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		files       string
+	}{
+		{"test with namespace profile", nil, strings.Join(lxcfsProfiles[lxcfsProfileMinimal], ",")},
+		{"test with pod profile", map[string]string{admissionWebhookAnnotationProfileKey: lxcfsProfileMemory}, strings.Join(lxcfsProfiles[lxcfsProfileMemory], ",")},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+
+		ar := GetAdmissionReviewExample()
+		var pod corev1.Pod
+		if err := json.Unmarshal(ar.Request.Object.Raw, &pod); err != nil {
+			t.Fatal(err)
+		}
+		pod.Annotations = testCase.annotations
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "sidecar", Image: "busybox"})
+		ar.Request.Object.Raw, _ = json.Marshal(pod)
+
+		admissionResponse := whsvr.mutate(ar)
+		assert.Equal(t, admissionResponse.Allowed, true)
+		patch := string(admissionResponse.Patch)
+		assert.Equal(t, strings.Contains(patch, "\"/spec/containers/1/volumeMounts\""), false, patch)
+		assert.Equal(t, strings.Contains(patch, testCase.files), true, patch)
+		// the namespace annotations are not copied to the pod
+		assert.Equal(t, strings.Contains(patch, admissionWebhookAnnotationExcludeContainersKey), false, patch)
+	}
+}
+
+func TestNamespaceWatcherDefaults(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "annotated",
+			Annotations: map[string]string{admissionWebhookAnnotationProfileKey: lxcfsProfileMinimal},
+		}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   "labeled",
+			Labels: map[string]string{admissionWebhookAnnotationEnableKey: "false", admissionWebhookAnnotationProfileKey: lxcfsProfileCPU},
+		}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "both",
+			Labels:      map[string]string{admissionWebhookAnnotationProfileKey: lxcfsProfileCPU, "team": "demo"},
+			Annotations: map[string]string{admissionWebhookAnnotationProfileKey: lxcfsProfileMemory},
+		}},
+	)
+	watcher := newNamespaceWatcher(informers.NewSharedInformerFactory(client, 0))
+	assert.Equal(t, watcher.defaults("annotated") == nil, true)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go watcher.run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, watcher.synced) {
+		t.Fatal("namespaces cache not synced")
+	}
+
+	testCases := []struct {
+		name      string
+		namespace string
+		except    map[string]string
+	}{
+		{"test with namespace annotations", "annotated", map[string]string{admissionWebhookAnnotationProfileKey: lxcfsProfileMinimal}},
+		{"test with namespace labels", "labeled", map[string]string{admissionWebhookAnnotationEnableKey: "false", admissionWebhookAnnotationProfileKey: lxcfsProfileCPU}},
+		{"test with annotations override labels", "both", map[string]string{admissionWebhookAnnotationProfileKey: lxcfsProfileMemory, "team": "demo"}},
+		{"test with namespace not found", "missing", nil},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+		assert.DeepEqual(t, watcher.defaults(testCase.namespace), testCase.except)
+	}
+}
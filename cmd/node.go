@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// the node label set by the node controller on the nodes where the LXCFS DaemonSet pod is ready
+const (
+	lxcfsReadyNodeLabel      = "lxcfs-admission-webhook.io/lxcfs-ready"
+	lxcfsReadyNodeLabelValue = "true"
+)
+
+// default label selector of the LXCFS DaemonSet pods, see deploy/lxcfs-daemonset.tpl.yaml
+const defaultLxcfsPodSelector = "app=lxcfs-ds"
+
+// the Lease in the webhook namespace, only the webhook replica holding it labels the nodes
+const nodeControllerLeaseName = "lxcfs-admission-webhook-node-controller"
+
+var (
+	nodeControllerLeaseDuration = 15 * time.Second
+	nodeControllerRenewDeadline = 10 * time.Second
+	nodeControllerRetryPeriod   = 2 * time.Second
+)
+
+// the index of the LXCFS pods by the node name
+const podNodeNameIndex = "spec.nodeName"
+
+// lxcfsNodeRequirement the node affinity requirement added to the mutated pods,
+// so they are only scheduled to the nodes where LXCFS is ready
+var lxcfsNodeRequirement = corev1.NodeSelectorRequirement{
+	Key:      lxcfsReadyNodeLabel,
+	Operator: corev1.NodeSelectorOpIn,
+	Values:   []string{lxcfsReadyNodeLabelValue},
+}
+
+// nodeController label the nodes where the LXCFS DaemonSet pod is ready, and remove the label when the pod goes away
+type nodeController struct {
+	client      kubernetes.Interface
+	namespace   string                          // where the LXCFS pods and the Lease are
+	identity    string                          // the holder identity of the Lease, unique in the webhook replicas
+	factory     informers.SharedInformerFactory // the LXCFS pods in namespace
+	nodeFactory informers.SharedInformerFactory // shared by the watchers
+	pods        cache.Indexer                   // indexed by podNodeNameIndex
+	nodes       corelisters.NodeLister
+	selector    labels.Selector
+	synced      []cache.InformerSynced
+	queue       workqueue.RateLimitingInterface // node names to reconcile
+}
+
+// newNodeController create nodeController watching the LXCFS DaemonSet pods selected by podSelector in namespace,
+// the nodes are cached by nodeFactory shared by the watchers
+func newNodeController(client kubernetes.Interface, nodeFactory informers.SharedInformerFactory, namespace, podSelector, identity string) (*nodeController, error) {
+	selector, err := labels.Parse(podSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LXCFS pod selector %q: %v", podSelector, err)
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace(namespace))
+	pods := factory.Core().V1().Pods()
+	nodes := nodeFactory.Core().V1().Nodes()
+	err = pods.Informer().AddIndexers(cache.Indexers{podNodeNameIndex: func(obj interface{}) ([]string, error) {
+		if pod, ok := obj.(*corev1.Pod); ok && pod.Spec.NodeName != "" {
+			return []string{pod.Spec.NodeName}, nil
+		}
+		return nil, nil
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &nodeController{
+		client:      client,
+		namespace:   namespace,
+		identity:    identity,
+		factory:     factory,
+		nodeFactory: nodeFactory,
+		pods:        pods.Informer().GetIndexer(),
+		nodes:       nodes.Lister(),
+		selector:    selector,
+		synced:      []cache.InformerSynced{pods.Informer().HasSynced, nodes.Informer().HasSynced},
+		queue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "lxcfs-nodes"),
+	}
+
+	pods.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueuePod,
+		UpdateFunc: func(_, obj interface{}) { c.enqueuePod(obj) },
+		DeleteFunc: c.enqueuePod,
+	})
+	nodes.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueueNode,
+		UpdateFunc: c.updateNode,
+	})
+	return c, nil
+}
+
+func (c *nodeController) enqueuePod(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || pod.Spec.NodeName == "" || !c.selector.Matches(labels.Set(pod.Labels)) {
+		return
+	}
+	c.queue.Add(pod.Spec.NodeName)
+}
+
+func (c *nodeController) enqueueNode(obj interface{}) {
+	if node, ok := obj.(*corev1.Node); ok {
+		c.queue.Add(node.Name)
+	}
+}
+
+// updateNode enqueue the node if the LXCFS ready label changed, the status updates of the nodes are ignored
+func (c *nodeController) updateNode(old, obj interface{}) {
+	oldNode, ok := old.(*corev1.Node)
+	node, ok2 := obj.(*corev1.Node)
+	if ok && ok2 && oldNode.Labels[lxcfsReadyNodeLabel] == node.Labels[lxcfsReadyNodeLabel] {
+		return
+	}
+	c.enqueueNode(obj)
+}
+
+// run reconcile the node labels in the webhook replica holding the Lease until stopCh closed,
+// all the replicas cache the pods and nodes, so the next leader takes over at once
+func (c *nodeController) run(stopCh <-chan struct{}) {
+	defer c.queue.ShutDown()
+
+	c.factory.Start(stopCh)
+	c.nodeFactory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.synced...) {
+		defaultLogger.error("Failed to sync node controller cache")
+		return
+	}
+	defaultLogger.info("Node controller started", "identity", c.identity)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	// try to acquire the Lease again after the leadership lost, until stopped
+	for ctx.Err() == nil {
+		elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock: &resourcelock.LeaseLock{
+				LeaseMeta:  metav1.ObjectMeta{Namespace: c.namespace, Name: nodeControllerLeaseName},
+				Client:     c.client.CoordinationV1(),
+				LockConfig: resourcelock.ResourceLockConfig{Identity: c.identity},
+			},
+			LeaseDuration:   nodeControllerLeaseDuration,
+			RenewDeadline:   nodeControllerRenewDeadline,
+			RetryPeriod:     nodeControllerRetryPeriod,
+			ReleaseOnCancel: true,
+			Name:            nodeControllerLeaseName,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: c.lead,
+				OnStoppedLeading: func() {
+					defaultLogger.info("Node controller stopped leading", "identity", c.identity)
+				},
+			},
+		})
+		if err != nil {
+			defaultLogger.error("Failed to create node controller leader elector", "error", err)
+			return
+		}
+		elector.Run(ctx)
+	}
+}
+
+// lead reconcile the node labels until the leadership lost
+func (c *nodeController) lead(ctx context.Context) {
+	defaultLogger.info("Node controller started leading", "identity", c.identity)
+
+	// the nodes may be reconciled by the previous leader partly
+	nodes, err := c.nodes.List(labels.Everything())
+	if err != nil {
+		defaultLogger.error("Failed to list nodes", "error", err)
+	}
+	for _, node := range nodes {
+		c.queue.Add(node.Name)
+	}
+	for c.processNextNode(ctx) {
+	}
+}
+
+// processNextNode reconcile the next node in queue, return false if the queue shut down or the leadership lost
+func (c *nodeController) processNextNode(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if ctx.Err() != nil {
+		// leave the node to the next leadership
+		c.queue.Add(key)
+		return false
+	}
+
+	name := key.(string)
+	if err := c.reconcile(ctx, name); err != nil {
+		defaultLogger.warning("Failed to reconcile LXCFS node label, retry later", "node", name, "error", err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// lxcfsReady check whether any LXCFS pod is ready on the node
+func (c *nodeController) lxcfsReady(nodeName string) (bool, error) {
+	objs, err := c.pods.ByIndex(podNodeNameIndex, nodeName)
+	if err != nil {
+		return false, err
+	}
+	for _, obj := range objs {
+		pod, ok := obj.(*corev1.Pod)
+		if ok && c.selector.Matches(labels.Set(pod.Labels)) && pod.DeletionTimestamp == nil && podReady(pod) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// reconcile set the node label if LXCFS is ready on the node, or remove it
+func (c *nodeController) reconcile(ctx context.Context, nodeName string) error {
+	node, err := c.nodes.Get(nodeName)
+	if err != nil {
+		// the node deleted, nothing to do
+		return nil
+	}
+
+	ready, err := c.lxcfsReady(nodeName)
+	if err != nil {
+		return err
+	}
+	labeled := node.Labels[lxcfsReadyNodeLabel] == lxcfsReadyNodeLabelValue
+	if ready == labeled {
+		return nil
+	}
+
+	// remove the label by null value of JSON merge patch
+	var value interface{}
+	if ready {
+		value = lxcfsReadyNodeLabelValue
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]interface{}{lxcfsReadyNodeLabel: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := c.client.CoreV1().Nodes().Patch(ctx, nodeName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return err
+	}
+	defaultLogger.info("Updated LXCFS node label", "node", nodeName, "ready", ready)
+	return nil
+}
+
+// podReady check whether the pod condition Ready is true
+func podReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// patchNodeAffinity add the required node affinity requirement to the pod,
+// the requirement is added to every node selector term, as the terms are ORed
+func patchNodeAffinity(pod *corev1.Pod, requirement *corev1.NodeSelectorRequirement) (patches []patchOperation) {
+	if requirement == nil {
+		return nil
+	}
+
+	term := corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{*requirement}}
+	affinity := pod.Spec.Affinity
+	switch {
+	case affinity == nil:
+		return append(patches, patchOperation{
+			Op:   "add",
+			Path: "/spec/affinity",
+			Value: corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{term}},
+			}},
+		})
+	case affinity.NodeAffinity == nil:
+		return append(patches, patchOperation{
+			Op:   "add",
+			Path: "/spec/affinity/nodeAffinity",
+			Value: corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{term}},
+			},
+		})
+	case affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil ||
+		len(affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms) == 0:
+		return append(patches, patchOperation{
+			Op:    "add",
+			Path:  "/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution",
+			Value: corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{term}},
+		})
+	}
+
+	for idx, t := range affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		path := fmt.Sprintf("/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution/nodeSelectorTerms/%d/matchExpressions", idx)
+		if len(t.MatchExpressions) == 0 {
+			patches = append(patches, patchOperation{Op: "add", Path: path, Value: term.MatchExpressions})
+			continue
+		}
+		patches = append(patches, patchOperation{Op: "add", Path: path + "/-", Value: *requirement})
+	}
+	return patches
+}
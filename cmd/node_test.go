@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPatchNodeAffinity(t *testing.T) {
+	expression := corev1.NodeSelectorRequirement{Key: "zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"a"}}
+	field := corev1.NodeSelectorRequirement{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"node1"}}
+
+	testCases := []struct {
+		name     string
+		affinity *corev1.Affinity
+		paths    []string
+	}{
+		{"test without affinity", nil, []string{"/spec/affinity"}},
+		{"test without node affinity", &corev1.Affinity{PodAffinity: &corev1.PodAffinity{}}, []string{"/spec/affinity/nodeAffinity"}},
+		{"test with preferred node affinity only", &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{}},
+			[]string{"/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution"}},
+		{"test with node selector terms", &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{expression}},
+				{MatchFields: []corev1.NodeSelectorRequirement{field}},
+			}},
+		}}, []string{
+			"/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution/nodeSelectorTerms/0/matchExpressions/-",
+			"/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution/nodeSelectorTerms/1/matchExpressions",
+		}},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+
+		pod := corev1.Pod{Spec: corev1.PodSpec{Affinity: testCase.affinity}}
+		patches := patchNodeAffinity(&pod, &lxcfsNodeRequirement)
+		paths := make([]string, 0, len(patches))
+		for _, patch := range patches {
+			assert.Equal(t, patch.Op, "add")
+			paths = append(paths, patch.Path)
+		}
+		assert.DeepEqual(t, paths, testCase.paths)
+	}
+
+	assert.Equal(t, len(patchNodeAffinity(&corev1.Pod{}, nil)), 0)
+}
+
+func TestWebhookServerMutateWithNodeAffinity(t *testing.T) {
+	whsvr := NewWebhookServer()
+
+	for _, nodeAffinity := range []bool{false, true} {
+		policy, err := newWebhookPolicy(webhookConfig{NodeAffinity: nodeAffinity})
+		if err != nil {
+			t.Fatal(err)
+		}
+		whsvr.setPolicy(policy)
+
+		admissionResponse := whsvr.mutate(GetAdmissionReviewExample())
+		assert.Equal(t, admissionResponse.Allowed, true)
+		assert.Equal(t, strings.Contains(string(admissionResponse.Patch), lxcfsReadyNodeLabel), nodeAffinity)
+	}
+}
+
+func lxcfsPodExample(name, nodeName string, ready bool) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "lxcfs", Name: name, Labels: map[string]string{"app": "lxcfs-ds"}},
+		Spec:       corev1.PodSpec{NodeName: nodeName},
+		Status:     corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}}},
+	}
+}
+
+func TestNodeController(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2", Labels: map[string]string{lxcfsReadyNodeLabel: lxcfsReadyNodeLabelValue}}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node3"}},
+		lxcfsPodExample("lxcfs-ds-1", "node1", true),
+		lxcfsPodExample("lxcfs-ds-3", "node3", false),
+	)
+
+	factory := informers.NewSharedInformerFactory(client, 0)
+	_, err := newNodeController(client, factory, "lxcfs", "app in (", "webhook-0")
+	assert.Equal(t, err != nil, true)
+
+	controller, err := newNodeController(client, factory, "lxcfs", defaultLxcfsPodSelector, "webhook-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go controller.run(stopCh)
+
+	waitLabels := func(except map[string]bool) {
+		err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			for name, labeled := range except {
+				node, err := client.CoreV1().Nodes().Get(context.Background(), name, metav1.GetOptions{})
+				if err != nil {
+					return false, err
+				}
+				if (node.Labels[lxcfsReadyNodeLabel] == lxcfsReadyNodeLabelValue) != labeled {
+					return false, nil
+				}
+			}
+			return true, nil
+		})
+		assert.NilError(t, err, "except node labels %v", except)
+	}
+
+	waitLabels(map[string]bool{"node1": true, "node2": false, "node3": false})
+
+	// the label removed when the LXCFS pod goes away, and added when the pod ready
+	if err := client.CoreV1().Pods("lxcfs").Delete(context.Background(), "lxcfs-ds-1", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CoreV1().Pods("lxcfs").UpdateStatus(context.Background(), lxcfsPodExample("lxcfs-ds-3", "node3", true), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitLabels(map[string]bool{"node1": false, "node2": false, "node3": true})
+}
+
+func TestNodeControllerUpdateNode(t *testing.T) {
+	controller, err := newNodeController(fake.NewSimpleClientset(), informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0),
+		"lxcfs", defaultLxcfsPodSelector, "webhook-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer controller.queue.ShutDown()
+
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"zone": "a"}}}
+	testCases := []struct {
+		name     string
+		labels   map[string]string
+		enqueued bool
+	}{
+		{"test with status updated", map[string]string{"zone": "a"}, false},
+		{"test with other label changed", map[string]string{"zone": "b"}, false},
+		{"test with LXCFS ready label added", map[string]string{"zone": "a", lxcfsReadyNodeLabel: lxcfsReadyNodeLabelValue}, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+		updated := node.DeepCopy()
+		updated.Labels = testCase.labels
+		updated.Status.Phase = corev1.NodeRunning
+		controller.updateNode(node, updated)
+		assert.Equal(t, controller.queue.Len() > 0, testCase.enqueued)
+	}
+}
+
+func TestNodeControllerLeaderElection(t *testing.T) {
+	defer func(duration, deadline, period time.Duration) {
+		nodeControllerLeaseDuration, nodeControllerRenewDeadline, nodeControllerRetryPeriod = duration, deadline, period
+	}(nodeControllerLeaseDuration, nodeControllerRenewDeadline, nodeControllerRetryPeriod)
+	nodeControllerLeaseDuration, nodeControllerRenewDeadline, nodeControllerRetryPeriod = time.Second, 500*time.Millisecond, 100*time.Millisecond
+
+	client := fake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		lxcfsPodExample("lxcfs-ds-1", "node1", true),
+	)
+	holder := func() string {
+		lease, err := client.CoordinationV1().Leases("lxcfs").Get(context.Background(), nodeControllerLeaseName, metav1.GetOptions{})
+		if err != nil || lease.Spec.HolderIdentity == nil {
+			return ""
+		}
+		return *lease.Spec.HolderIdentity
+	}
+
+	stopChs := make(map[string]chan struct{})
+	for _, identity := range []string{"webhook-0", "webhook-1"} {
+		controller, err := newNodeController(client, informers.NewSharedInformerFactory(client, 0), "lxcfs", defaultLxcfsPodSelector, identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stopChs[identity] = make(chan struct{})
+		go controller.run(stopChs[identity])
+	}
+
+	// one of the replicas labels the nodes
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		node, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+		return err == nil && node.Labels[lxcfsReadyNodeLabel] == lxcfsReadyNodeLabelValue && holder() != "", err
+	})
+	assert.NilError(t, err)
+
+	// the other one takes over after the leader stopped
+	leader := holder()
+	close(stopChs[leader])
+	delete(stopChs, leader)
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return holder() != "" && holder() != leader, nil
+	})
+	assert.NilError(t, err)
+	for _, stopCh := range stopChs {
+		close(stopCh)
+	}
+}
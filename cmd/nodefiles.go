@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// the node annotations published by the node agent, the LXCFS files supported by the node in comma separated list,
+// and the cgroup mode of the node
+const (
+	lxcfsFilesNodeAnnotation = "lxcfs-admission-webhook.io/lxcfs-files"
+	cgroupModeNodeAnnotation = "lxcfs-admission-webhook.io/cgroup-mode"
+)
+
+const (
+	cgroupModeV1 = "v1"
+	cgroupModeV2 = "v2"
+)
+
+// the profile of the LXCFS files in the full profile supported by all the nodes the pod can be scheduled to,
+// the default profile if the node files watched
+const lxcfsProfileSupported = "supported"
+
+// cgroupMode the cgroup mode of the node by the cgroup root
+func cgroupMode(cgroupRoot string) string {
+	if cgroupV2(cgroupRoot) {
+		return cgroupModeV2
+	}
+	return cgroupModeV1
+}
+
+// supportedFiles the LXCFS files in the catalogue provided by the LXCFS mounted, which depends on
+// the LXCFS version, its flags and the cgroup mode of the node
+func (a *lxcfsAgent) supportedFiles() []string {
+	var files []string
+	for _, f := range lxcfsFileCatalogue {
+		if a.mounter.connected(a.pid, a.source(f.path)) {
+			files = append(files, f.path)
+		}
+	}
+	return files
+}
+
+// nodeFilesPublisher publish the LXCFS files supported by the node and its cgroup mode to the node annotations
+type nodeFilesPublisher struct {
+	client     kubernetes.Interface
+	node       string
+	cgroupMode string
+	published  map[string]string // the annotations published last time, nil before published
+}
+
+// publish patch the node annotations if changed since last published, return whether the node is patched
+func (p *nodeFilesPublisher) publish(ctx context.Context, files []string) (bool, error) {
+	annotations := map[string]string{
+		lxcfsFilesNodeAnnotation: strings.Join(files, ","),
+		cgroupModeNodeAnnotation: p.cgroupMode,
+	}
+	if p.published != nil && p.published[lxcfsFilesNodeAnnotation] == annotations[lxcfsFilesNodeAnnotation] &&
+		p.published[cgroupModeNodeAnnotation] == annotations[cgroupModeNodeAnnotation] {
+		return false, nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return false, err
+	}
+	if _, err := p.client.CoreV1().Nodes().Patch(ctx, p.node, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return false, err
+	}
+	p.published = annotations
+	return true, nil
+}
+
+// nodeFilesWatcher cache the nodes by informer, provide the LXCFS files supported by the nodes
+type nodeFilesWatcher struct {
+	factory informers.SharedInformerFactory
+	lister  corelisters.NodeLister
+	synced  cache.InformerSynced
+}
+
+// newNodeFilesWatcher create nodeFilesWatcher by the informer factory shared by the watchers,
+// the cache is filled after run
+func newNodeFilesWatcher(factory informers.SharedInformerFactory) *nodeFilesWatcher {
+	informer := factory.Core().V1().Nodes()
+	return &nodeFilesWatcher{
+		factory: factory,
+		lister:  informer.Lister(),
+		synced:  informer.Informer().HasSynced,
+	}
+}
+
+// run watch the nodes until stopCh closed
+func (w *nodeFilesWatcher) run(stopCh <-chan struct{}) {
+	w.factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, w.synced) {
+		defaultLogger.error("Failed to sync nodes cache")
+		return
+	}
+	defaultLogger.info("Nodes cache synced")
+}
+
+// supported get the LXCFS files of the full profile supported by all the nodes the pod can be scheduled to,
+// by its nodeSelector and required node affinity, with requirement added to the node affinity if not nil.
+// The nodes not published the LXCFS files yet are unknown, they are assumed to provide the minimal profile only.
+// Nil if no node the pod can be scheduled to, or the cache not synced.
+func (w *nodeFilesWatcher) supported(pod *corev1.Pod, requirement *corev1.NodeSelectorRequirement) []string {
+	if w == nil || !w.synced() {
+		return nil
+	}
+	nodes, err := w.lister.List(labels.SelectorFromSet(pod.Spec.NodeSelector))
+	if err != nil {
+		return nil
+	}
+	terms := requiredNodeSelectorTerms(pod, requirement)
+
+	candidates := 0
+	counts := make(map[string]int)
+	for _, node := range nodes {
+		if !nodeSelectorTermsMatch(terms, node) {
+			continue
+		}
+		candidates++
+		files := annotationList(node.Annotations, lxcfsFilesNodeAnnotation)
+		if files == nil {
+			files = make(map[string]bool)
+			for _, file := range lxcfsProfiles[lxcfsProfileMinimal] {
+				files[file] = true
+			}
+		}
+		for file := range files {
+			counts[file]++
+		}
+	}
+	if candidates == 0 {
+		return nil
+	}
+
+	files := []string{}
+	for _, file := range lxcfsFiles {
+		if counts[file] == candidates {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// requiredNodeSelectorTerms the required node affinity terms of the pod, with requirement added to every term
+// if not nil, the same as patchNodeAffinity does. Nil if the pod has no required node affinity.
+func requiredNodeSelectorTerms(pod *corev1.Pod, requirement *corev1.NodeSelectorRequirement) []corev1.NodeSelectorTerm {
+	var terms []corev1.NodeSelectorTerm
+	if affinity := pod.Spec.Affinity; affinity != nil && affinity.NodeAffinity != nil &&
+		affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+		terms = affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	}
+	if requirement == nil {
+		return terms
+	}
+	if len(terms) == 0 {
+		return []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{*requirement}}}
+	}
+
+	added := make([]corev1.NodeSelectorTerm, 0, len(terms))
+	for _, term := range terms {
+		term.MatchExpressions = append(append([]corev1.NodeSelectorRequirement{}, term.MatchExpressions...), *requirement)
+		added = append(added, term)
+	}
+	return added
+}
+
+// nodeSelectorTermsMatch check whether the node matches any of the node selector terms, true if no term
+func nodeSelectorTermsMatch(terms []corev1.NodeSelectorTerm, node *corev1.Node) bool {
+	if len(terms) == 0 {
+		return true
+	}
+	for _, term := range terms {
+		if nodeSelectorTermMatch(term, node) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeSelectorTermMatch check whether the node matches all the requirements of the term,
+// the term without any requirement matches no node, the same as the scheduler
+func nodeSelectorTermMatch(term corev1.NodeSelectorTerm, node *corev1.Node) bool {
+	if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+		return false
+	}
+
+	for _, r := range term.MatchExpressions {
+		var op selection.Operator
+		switch r.Operator {
+		case corev1.NodeSelectorOpIn:
+			op = selection.In
+		case corev1.NodeSelectorOpNotIn:
+			op = selection.NotIn
+		case corev1.NodeSelectorOpExists:
+			op = selection.Exists
+		case corev1.NodeSelectorOpDoesNotExist:
+			op = selection.DoesNotExist
+		case corev1.NodeSelectorOpGt:
+			op = selection.GreaterThan
+		case corev1.NodeSelectorOpLt:
+			op = selection.LessThan
+		default:
+			return false
+		}
+		requirement, err := labels.NewRequirement(r.Key, op, r.Values)
+		if err != nil || !requirement.Matches(labels.Set(node.Labels)) {
+			return false
+		}
+	}
+
+	// only metadata.name is supported by the field selector of node affinity
+	for _, r := range term.MatchFields {
+		if r.Key != "metadata.name" {
+			return false
+		}
+		in := false
+		for _, value := range r.Values {
+			in = in || value == node.Name
+		}
+		switch {
+		case r.Operator == corev1.NodeSelectorOpIn && in:
+		case r.Operator == corev1.NodeSelectorOpNotIn && !in:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// profiles add the supported profile of the pod to the profiles, return the default profile of the pod,
+// requirement is the node affinity requirement added to the pod if not nil. The profiles are not modified.
+func (w *nodeFilesWatcher) profiles(profiles map[string][]string, pod *corev1.Pod, requirement *corev1.NodeSelectorRequirement) (map[string][]string, string) {
+	files := w.supported(pod, requirement)
+	if files == nil {
+		return profiles, lxcfsProfileFull
+	}
+
+	added := make(map[string][]string, len(profiles)+1)
+	for name, f := range profiles {
+		added[name] = f
+	}
+	added[lxcfsProfileSupported] = files
+	return added, lxcfsProfileSupported
+}
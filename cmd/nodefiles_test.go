@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNodeFilesPublisher(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: map[string]string{"foo": "bar"}}})
+	publisher := &nodeFilesPublisher{client: client, node: "node1", cgroupMode: cgroupModeV2}
+
+	testCases := []struct {
+		name      string
+		files     []string
+		published bool
+	}{
+		{"test with first publish", lxcfsFiles, true},
+		{"test with files unchanged", lxcfsFiles, false},
+		{"test with files changed", lxcfsProfiles[lxcfsProfileMinimal], true},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+		published, err := publisher.publish(context.Background(), testCase.files)
+		assert.NilError(t, err)
+		assert.Equal(t, published, testCase.published)
+
+		node, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+		assert.NilError(t, err)
+		assert.DeepEqual(t, node.Annotations, map[string]string{
+			"foo":                    "bar",
+			lxcfsFilesNodeAnnotation: strings.Join(testCase.files, ","),
+			cgroupModeNodeAnnotation: cgroupModeV2,
+		})
+	}
+}
+
+func nodeExample(name, pool, files string, ready bool) *corev1.Node {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"pool": pool}}}
+	if ready {
+		node.Labels[lxcfsReadyNodeLabel] = lxcfsReadyNodeLabelValue
+	}
+	if files != "" {
+		node.Annotations = map[string]string{lxcfsFilesNodeAnnotation: files}
+	}
+	return node
+}
+
+// podWithAffinity the pod scheduled by the required node affinity terms
+func podWithAffinity(terms ...corev1.NodeSelectorTerm) *corev1.Pod {
+	return &corev1.Pod{Spec: corev1.PodSpec{Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: terms},
+	}}}}
+}
+
+func TestNodeFilesWatcher(t *testing.T) {
+	withoutSwaps := []string{}
+	for _, file := range lxcfsFiles {
+		if file != "/proc/swaps" {
+			withoutSwaps = append(withoutSwaps, file)
+		}
+	}
+	minimal := lxcfsProfiles[lxcfsProfileMinimal]
+
+	client := fake.NewSimpleClientset(
+		nodeExample("node1", "a", strings.Join(catalogueFiles(), ","), true),
+		nodeExample("node2", "b", strings.Join(withoutSwaps, ","), true),
+		nodeExample("node3", "b", "", false),
+		nodeExample("node4", "c", "", false),
+	)
+	watcher := newNodeFilesWatcher(informers.NewSharedInformerFactory(client, 0))
+	assert.Equal(t, watcher.supported(&corev1.Pod{}, nil) == nil, true)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go watcher.run(stopCh)
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return watcher.synced(), nil
+	})
+	assert.NilError(t, err)
+
+	poolIn := func(pools ...string) corev1.NodeSelectorRequirement {
+		return corev1.NodeSelectorRequirement{Key: "pool", Operator: corev1.NodeSelectorOpIn, Values: pools}
+	}
+	testCases := []struct {
+		name        string
+		pod         *corev1.Pod
+		requirement *corev1.NodeSelectorRequirement
+		except      []string
+	}{
+		{"test with all nodes", &corev1.Pod{}, nil, minimal},
+		{"test with all nodes LXCFS ready", &corev1.Pod{}, &lxcfsNodeRequirement, withoutSwaps},
+		{"test with node pool", &corev1.Pod{Spec: corev1.PodSpec{NodeSelector: map[string]string{"pool": "a"}}}, nil, lxcfsFiles},
+		{"test with node pool partly published", &corev1.Pod{Spec: corev1.PodSpec{NodeSelector: map[string]string{"pool": "b"}}}, nil, minimal},
+		{"test with node pool LXCFS ready", &corev1.Pod{Spec: corev1.PodSpec{NodeSelector: map[string]string{"pool": "b"}}}, &lxcfsNodeRequirement, withoutSwaps},
+		{"test with node pool not published", &corev1.Pod{Spec: corev1.PodSpec{NodeSelector: map[string]string{"pool": "c"}}}, nil, minimal},
+		{"test with node pool not exist", &corev1.Pod{Spec: corev1.PodSpec{NodeSelector: map[string]string{"pool": "d"}}}, nil, nil},
+		{"test with node affinity", podWithAffinity(corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{poolIn("a")}}), nil, lxcfsFiles},
+		{"test with node affinity terms", podWithAffinity(
+			corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{poolIn("a")}},
+			corev1.NodeSelectorTerm{MatchFields: []corev1.NodeSelectorRequirement{{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"node2"}}}},
+		), nil, withoutSwaps},
+		{"test with node affinity LXCFS ready", podWithAffinity(corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{poolIn("b", "c")}}), &lxcfsNodeRequirement, withoutSwaps},
+		{"test with node affinity not matched", podWithAffinity(corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{poolIn("c")}}), &lxcfsNodeRequirement, nil},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+		assert.DeepEqual(t, watcher.supported(testCase.pod, testCase.requirement), testCase.except)
+
+		profiles, defaultProfile := watcher.profiles(lxcfsProfiles, testCase.pod, testCase.requirement)
+		if testCase.except == nil {
+			assert.Equal(t, defaultProfile, lxcfsProfileFull)
+			continue
+		}
+		assert.Equal(t, defaultProfile, lxcfsProfileSupported)
+		assert.DeepEqual(t, profiles[lxcfsProfileSupported], testCase.except)
+		assert.DeepEqual(t, profiles[lxcfsProfileCPU], lxcfsProfiles[lxcfsProfileCPU])
+	}
+	_, ok := lxcfsProfiles[lxcfsProfileSupported]
+	assert.Equal(t, ok, false)
+
+	// the pods are mutated with the LXCFS files supported by all the nodes by default,
+	// the nodes not published provide the minimal profile only
+	whsvr := NewWebhookServer()
+	whsvr.nodeFiles = watcher
+	admissionResponse := whsvr.mutate(GetAdmissionReviewExample())
+	assert.Equal(t, admissionResponse.Allowed, true)
+	patch := string(admissionResponse.Patch)
+	assert.Equal(t, strings.Contains(patch, strings.Join(minimal, ",")+"\""), true, patch)
+	assert.Equal(t, strings.Contains(patch, "/proc/swaps"), false, patch)
+
+	// the LXCFS ready nodes only with the node affinity added
+	policy, err := newWebhookPolicy(webhookConfig{NodeAffinity: true})
+	assert.NilError(t, err)
+	whsvr.setPolicy(policy)
+	admissionResponse = whsvr.mutate(GetAdmissionReviewExample())
+	assert.Equal(t, admissionResponse.Allowed, true)
+	patch = string(admissionResponse.Patch)
+	assert.Equal(t, strings.Contains(patch, strings.Join(withoutSwaps, ",")), true, patch)
+	assert.Equal(t, strings.Contains(patch, "/proc/swaps"), false, patch)
+}
+
+// catalogueFiles the paths of all the files in the LXCFS file catalogue
+func catalogueFiles() (files []string) {
+	for _, f := range lxcfsFileCatalogue {
+		files = append(files, f.path)
+	}
+	return files
+}
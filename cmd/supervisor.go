@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// the supervisor subcommand, the entrypoint of the LXCFS DaemonSet image
+const superviseCommand = "supervise"
+
+// the LXCFS version provides cgroupfs only if enabled, and supports it on cgroup v1 only
+var lxcfsCgroupfsVersion = version.MustParseGeneric("5.0.0")
+
+// lxcfsOptions the LXCFS features to enable
+type lxcfsOptions struct {
+	loadavg     bool // --enable-loadavg
+	cfs         bool // --enable-cfs
+	disableSwap bool // --disable-swap
+	pidfd       bool // --enable-pidfd
+	cgroupfs    bool // --enable-cgroup
+}
+
+// lxcfsArgs build the LXCFS command line arguments except the mount point,
+// the options not supported by the LXCFS version or the cgroup version are skipped
+func lxcfsArgs(options lxcfsOptions, lxcfsVersion *version.Version, cgroupV2 bool) []string {
+	args := []string{"--foreground"}
+	if options.loadavg {
+		args = append(args, "--enable-loadavg")
+	}
+	if options.cfs {
+		args = append(args, "--enable-cfs")
+	}
+	if options.disableSwap {
+		args = append(args, "--disable-swap")
+	}
+	if options.pidfd {
+		args = append(args, "--enable-pidfd")
+	}
+	if options.cgroupfs {
+		switch {
+		case cgroupV2:
+			defaultLogger.warning("Skip LXCFS cgroupfs, which is not supported on cgroup v2")
+		case !lxcfsVersion.AtLeast(lxcfsCgroupfsVersion):
+			defaultLogger.info("Skip flag --enable-cgroup, LXCFS provides cgroupfs by default before 5.0", "lxcfsVersion", lxcfsVersion.String())
+		default:
+			args = append(args, "--enable-cgroup")
+		}
+	}
+	return args
+}
+
+// cgroupV2 check whether the cgroup root is the unified hierarchy of cgroup v2
+func cgroupV2(cgroupRoot string) bool {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+// lxcfsStatus the LXCFS status reported by the supervisor
+type lxcfsStatus struct {
+	Running   bool     `json:"running"`
+	Pid       int      `json:"pid,omitempty"`
+	Mounted   bool     `json:"mounted"`
+	Restarts  int      `json:"restarts"`
+	LastError string   `json:"lastError,omitempty"`
+	Args      []string `json:"args"`
+	StrayPods []string `json:"strayPods,omitempty"` // the pods mounting the stray entries LXCFS refused to start over
+}
+
+// lxcfsSupervisor run LXCFS and restart it with backoff if it exited, the LXCFS files in containers are
+// remounted once LXCFS mounted, and unmounted before LXCFS stopped
+type lxcfsSupervisor struct {
+	binary         string
+	args           []string // the arguments except the mount point
+	agent          *lxcfsAgent
+	hostInitPid    int // the stale LXCFS mount is unmounted in the mount namespace of the host init process
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+	pollInterval   time.Duration // interval of checking LXCFS mounted
+	waitMounted    time.Duration
+	runtimeTimeout time.Duration
+	removeStray    bool // remove the stray entries in the mount point even if mounted by the running pods
+
+	mu     sync.Mutex
+	status lxcfsStatus
+}
+
+// cleanup unmount the LXCFS left by the last run, and remove the stray entries left in the mount point.
+// Nothing is removed if anything is still mounted at or under the mount point. The stray entries, e.g. the
+// directories created by kubelet for the subPath of pods started before LXCFS mounted, are not removed
+// if they are mounted by the running pods, unless removeStray set.
+func (s *lxcfsSupervisor) cleanup() error {
+	mountPoint := s.agent.source("/")
+	mounted, err := s.agent.lxcfsMounts(s.agent.pid)
+	if err != nil {
+		return err
+	}
+	for n := mounted[mountPoint]; n > 0; n-- {
+		if err := s.agent.mounter.unmount(s.hostInitPid, mountPoint); err != nil {
+			return fmt.Errorf("failed to unmount the LXCFS left: %v", err)
+		}
+		defaultLogger.info("Unmounted the LXCFS left", "mountPoint", mountPoint)
+	}
+
+	mounts, err := s.agent.mounter.mounts(s.agent.pid)
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		if m.mountPoint == mountPoint || strings.HasPrefix(m.mountPoint, mountPoint+"/") {
+			return fmt.Errorf("%s is still mounted at %s, refuse to clean up the mount point", m.fsType, m.mountPoint)
+		}
+	}
+
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(mountPoint)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		s.setStrayPods(nil)
+		return nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	pods, err := s.strayPods()
+	if err != nil {
+		return fmt.Errorf("failed to find the pods mounting the stray entries %v: %v", names, err)
+	}
+	s.setStrayPods(pods)
+	if len(pods) > 0 && !s.removeStray {
+		defaultLogger.warning("Stray entries in the mount point are mounted by pods, delete the pods to clean them up",
+			"mountPoint", mountPoint, "entries", strings.Join(names, ","), "pods", strings.Join(pods, ","))
+		return fmt.Errorf("stray entries %v in %s are mounted by pods %v, refuse to start LXCFS over them until they are cleaned up", names, mountPoint, pods)
+	}
+
+	for _, name := range names {
+		if err := os.RemoveAll(filepath.Join(mountPoint, name)); err != nil {
+			return err
+		}
+	}
+	defaultLogger.info("Removed stray entries in the mount point", "mountPoint", mountPoint, "entries", strings.Join(names, ","), "pods", strings.Join(pods, ","))
+	return nil
+}
+
+// strayPods the pods with the LXCFS files mounted from the stray entries, in namespace/name
+func (s *lxcfsSupervisor) strayPods() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.runtimeTimeout)
+	defer cancel()
+	containers, err := lxcfsContainers(ctx, s.agent.runtime, s.agent.lxcfsPods, s.agent.mount, s.agent.annotationPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	found := sets.NewString()
+	for _, c := range containers {
+		files, err := s.agent.strayFiles(c)
+		if err != nil {
+			return nil, fmt.Errorf("container %s of pod %s/%s: %v", c.name, c.podNamespace, c.podName, err)
+		}
+		if len(files) > 0 {
+			found.Insert(c.podNamespace + "/" + c.podName)
+		}
+	}
+	if found.Len() == 0 {
+		return nil, nil
+	}
+	return found.List(), nil
+}
+
+// run LXCFS until stopCh closed, restart it with backoff if it exited
+func (s *lxcfsSupervisor) run(stopCh <-chan struct{}) {
+	backoff := s.minBackoff
+	for {
+		started := time.Now()
+		err := s.cleanup()
+		if err == nil {
+			err = s.runOnce(stopCh)
+		}
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+
+		s.mu.Lock()
+		s.status.Restarts++
+		s.status.LastError = err.Error()
+		s.mu.Unlock()
+
+		// reset the backoff if LXCFS had been running for a while
+		if time.Since(started) > s.maxBackoff {
+			backoff = s.minBackoff
+		}
+		defaultLogger.error("LXCFS exited, restart it later", "error", err, "backoff", backoff.String())
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+// runOnce start LXCFS and wait for it exited, or stop it after the LXCFS files in containers unmounted if stopCh closed
+func (s *lxcfsSupervisor) runOnce(stopCh <-chan struct{}) error {
+	cmd := exec.Command(s.binary, append(append([]string{}, s.args...), s.agent.source("/"))...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defaultLogger.info("Started LXCFS", "pid", cmd.Process.Pid, "args", strings.Join(cmd.Args, " "))
+	s.setRunning(cmd.Process.Pid)
+	defer s.setRunning(0)
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.remountAfterMounted(ctx)
+
+	select {
+	case err := <-exited:
+		if err == nil {
+			err = errors.New("LXCFS exited")
+		}
+		return err
+	case <-stopCh:
+		cancel()
+		defaultLogger.info("Stopping LXCFS, unmount the LXCFS files in containers first")
+		s.adjust(context.Background(), agentActionUmount)
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(10 * time.Second):
+			_ = cmd.Process.Kill()
+			<-exited
+		}
+		return nil
+	}
+}
+
+// remountAfterMounted remount the LXCFS files in containers once LXCFS mounted, until ctx done
+func (s *lxcfsSupervisor) remountAfterMounted(ctx context.Context) {
+	waitCtx, cancel := context.WithTimeout(ctx, s.waitMounted)
+	defer cancel()
+	if err := wait.PollImmediateUntil(s.pollInterval, s.agent.lxcfsMounted, waitCtx.Done()); err != nil {
+		if ctx.Err() == nil {
+			defaultLogger.error("LXCFS not mounted in time", "mountPoint", s.agent.source("/"), "error", err)
+		}
+		return
+	}
+	defaultLogger.info("LXCFS mounted, remount the LXCFS files in containers", "mountPoint", s.agent.source("/"))
+	s.adjust(ctx, agentActionRemount)
+}
+
+// adjust the LXCFS mounts in containers by action
+func (s *lxcfsSupervisor) adjust(parent context.Context, action string) {
+	ctx, cancel := context.WithTimeout(parent, s.runtimeTimeout)
+	defer cancel()
+	if err := s.agent.run(ctx, action); err != nil {
+		defaultLogger.warning("Failed to adjust LXCFS mounts in some containers", "action", action, "error", err)
+	}
+}
+
+func (s *lxcfsSupervisor) setStrayPods(pods []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.StrayPods = pods
+}
+
+func (s *lxcfsSupervisor) setRunning(pid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Running, s.status.Pid = pid != 0, pid
+}
+
+// currentStatus the LXCFS status, whether LXCFS mounted is checked on call
+func (s *lxcfsSupervisor) currentStatus() lxcfsStatus {
+	s.mu.Lock()
+	status := s.status
+	s.mu.Unlock()
+	status.Args = s.args
+	status.Mounted, _ = s.agent.lxcfsMounted()
+	return status
+}
+
+// healthz liveness probe, the supervisor is alive if it can respond
+func (s *lxcfsSupervisor) healthz(w http.ResponseWriter, _ *http.Request) {
+	if _, err := fmt.Fprintf(w, "ok"); err != nil {
+		defaultLogger.error("Can't write response", "error", err)
+	}
+}
+
+// readyz readiness probe, fails when LXCFS is not running or not mounted
+func (s *lxcfsSupervisor) readyz(w http.ResponseWriter, _ *http.Request) {
+	status := s.currentStatus()
+	if !status.Running || !status.Mounted {
+		msg := fmt.Sprintf("LXCFS is not ready, running: %v, mounted: %v", status.Running, status.Mounted)
+		defaultLogger.warning(msg)
+		http.Error(w, msg, http.StatusServiceUnavailable)
+		return
+	}
+	if _, err := fmt.Fprintf(w, "ok"); err != nil {
+		defaultLogger.error("Can't write response", "error", err)
+	}
+}
+
+// statusz respond the LXCFS status in JSON
+func (s *lxcfsSupervisor) statusz(w http.ResponseWriter, _ *http.Request) {
+	resp, err := json.Marshal(s.currentStatus())
+	if err != nil {
+		defaultLogger.error("Can't encode response", "error", err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		defaultLogger.error("Can't write response", "error", err)
+	}
+}
+
+// runSupervise run the supervise subcommand with the command line arguments after it
+func runSupervise(args []string) error {
+	var parameters agentParameters
+	var options lxcfsOptions
+	var binary, lxcfsVersion, cgroupRoot string
+	var healthPort int
+	supervisor := &lxcfsSupervisor{hostInitPid: 1, pollInterval: time.Second}
+
+	flags := flag.NewFlagSet(superviseCommand, flag.ExitOnError)
+	flags.StringVar(&binary, "lxcfs", "/usr/bin/lxcfs", "Path of the LXCFS binary.")
+	flags.StringVar(&lxcfsVersion, "lxcfsVersion", os.Getenv("LXCFS_VERSION"), fmt.Sprintf("LXCFS version of the binary, %s if empty.", defaultLxcfsVersion))
+	flags.StringVar(&cgroupRoot, "cgroupRoot", "/sys/fs/cgroup", "Cgroup root of the host, to detect the cgroup version.")
+	flags.BoolVar(&options.loadavg, "enableLoadavg", true, "Enable LXCFS loadavg virtualization.")
+	flags.BoolVar(&options.cfs, "enableCfs", true, "Enable LXCFS CPU view by the CFS quota and period.")
+	flags.BoolVar(&options.disableSwap, "disableSwap", false, "Disable the swap in LXCFS meminfo and swaps.")
+	flags.BoolVar(&options.pidfd, "enablePidfd", false, "Enable LXCFS tracking the processes by pidfd.")
+	flags.BoolVar(&options.cgroupfs, "enableCgroupfs", false, "Enable LXCFS cgroupfs since LXCFS 5.0, skipped on cgroup v2.")
+	flags.DurationVar(&supervisor.minBackoff, "minBackoff", time.Second, "Initial delay of restarting LXCFS, doubled on each failure.")
+	flags.DurationVar(&supervisor.maxBackoff, "maxBackoff", time.Minute, "Maximum delay of restarting LXCFS.")
+	flags.DurationVar(&supervisor.waitMounted, "waitMounted", 30*time.Second, "Time to wait for LXCFS mounted before remount the LXCFS files in containers.")
+	flags.BoolVar(&supervisor.removeStray, "removeStrayEntries", false, "Remove the stray entries in the mount point even if mounted by the running pods, their LXCFS files are repaired once LXCFS mounted.")
+	flags.IntVar(&healthPort, "healthPort", 9103, "Port serves /healthz, /readyz and /status of LXCFS.")
+	parameters.addFlags(flags)
+	if err := parameters.parseSubcommandFlags(flags, args); err != nil {
+		return err
+	}
+
+	if lxcfsVersion == "" {
+		lxcfsVersion = defaultLxcfsVersion
+	}
+	v, err := version.ParseGeneric(lxcfsVersion)
+	if err != nil {
+		return fmt.Errorf("invalid LXCFS version %q: %v", lxcfsVersion, err)
+	}
+	v2 := cgroupV2(cgroupRoot)
+	supervisor.binary = binary
+	supervisor.args = lxcfsArgs(options, v, v2)
+	supervisor.runtimeTimeout = parameters.runtimeTimeout
+	defaultLogger.info("Chosen LXCFS flags", "lxcfsVersion", v.String(), "cgroupV2", v2, "args", strings.Join(supervisor.args, " "))
+
+	agent, conn, err := parameters.newAgent()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	supervisor.agent = agent
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", supervisor.healthz)
+	mux.HandleFunc("/readyz", supervisor.readyz)
+	mux.HandleFunc("/status", supervisor.statusz)
+	server := &http.Server{Addr: fmt.Sprintf(":%v", healthPort), Handler: mux}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			defaultLogger.error("Failed to serve LXCFS health", "error", err)
+		}
+	}()
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		supervisor.run(stopCh)
+		close(done)
+	}()
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	<-signalChan
+	defaultLogger.info("Got OS shutdown signal, stopping LXCFS")
+	close(stopCh)
+	<-done
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/apimachinery/pkg/util/wait"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestLxcfsArgs(t *testing.T) {
+	all := lxcfsOptions{loadavg: true, cfs: true, disableSwap: true, pidfd: true, cgroupfs: true}
+
+	testCases := []struct {
+		name         string
+		options      lxcfsOptions
+		lxcfsVersion string
+		cgroupV2     bool
+		except       []string
+	}{
+		{"test with defaults", lxcfsOptions{loadavg: true, cfs: true}, "4.0.12", false,
+			[]string{"--foreground", "--enable-loadavg", "--enable-cfs"}},
+		{"test with cgroupfs on cgroup v1", all, "5.0.0", false,
+			[]string{"--foreground", "--enable-loadavg", "--enable-cfs", "--disable-swap", "--enable-pidfd", "--enable-cgroup"}},
+		{"test with cgroupfs on cgroup v2", all, "5.0.0", true,
+			[]string{"--foreground", "--enable-loadavg", "--enable-cfs", "--disable-swap", "--enable-pidfd"}},
+		{"test with cgroupfs before LXCFS 5.0", lxcfsOptions{cgroupfs: true}, "4.0.12-r0", false,
+			[]string{"--foreground"}},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+		v := version.MustParseGeneric(testCase.lxcfsVersion)
+		assert.DeepEqual(t, lxcfsArgs(testCase.options, v, testCase.cgroupV2), testCase.except)
+	}
+}
+
+func TestCgroupV2(t *testing.T) {
+	root := t.TempDir()
+	assert.Equal(t, cgroupV2(root), false)
+	if err := os.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu memory"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, cgroupV2(root), true)
+}
+
+// newSupervisorExample create the supervisor runs the LXCFS script in the temporary host root,
+// and the fake mounter of the supervisor pid 300. The mutated pods in strayPods are running
+// with /proc/meminfo mounted from the stray directory in the mount point.
+func newSupervisorExample(t *testing.T, script string, strayPods ...string) (*lxcfsSupervisor, *fakeMounter) {
+	hostRoot := t.TempDir()
+	mount, err := newLxcfsMount(hostRoot, defaultLxcfsMountDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(hostRoot, "lxcfs.sh")
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mounter := &fakeMounter{
+		mountTable: map[int][]mountInfo{300: {}},
+		stale:      map[int]map[string]int{},
+		lxcfsUp:    true,
+		source:     filepath.Join(hostRoot, defaultLxcfsMountDir),
+	}
+	service := &fakeRuntimeService{statuses: make(map[string]*runtimeapi.ContainerStatusResponse)}
+	for i, pod := range strayPods {
+		service.sandboxes = append(service.sandboxes, &runtimeapi.PodSandbox{
+			Id:       pod,
+			Metadata: &runtimeapi.PodSandboxMetadata{Namespace: "demo", Name: pod},
+			State:    runtimeapi.PodSandboxState_SANDBOX_READY,
+			Annotations: map[string]string{
+				admissionWebhookAnnotationStatusKey:       admissionWebhookSuccessFlag,
+				admissionWebhookAnnotationMutatedFilesKey: "/proc/meminfo",
+			},
+		})
+		service.addContainer(pod, pod, 100+i, hostRoot, "/proc/meminfo")
+		mounter.mountTable[100+i] = []mountInfo{
+			{"/proc/meminfo", "proc", "/"},
+			{"/proc/meminfo", "ext4", filepath.Join(hostRoot, defaultLxcfsMountDir, "proc", "meminfo")},
+		}
+	}
+	return &lxcfsSupervisor{
+		binary: binary,
+		args:   []string{"--foreground"},
+		agent: &lxcfsAgent{
+			runtime:   startFakeRuntimeService(t, service),
+			mounter:   mounter,
+			mount:     mount,
+			lxcfsPods: labels.SelectorFromSet(labels.Set{"app": "lxcfs-ds"}),
+			pid:       300,
+			lockFile:  filepath.Join(t.TempDir(), "agent.lock"),
+		},
+		hostInitPid:    300,
+		minBackoff:     10 * time.Millisecond,
+		maxBackoff:     40 * time.Millisecond,
+		pollInterval:   10 * time.Millisecond,
+		waitMounted:    5 * time.Second,
+		runtimeTimeout: 5 * time.Second,
+	}, mounter
+}
+
+func TestLxcfsSupervisorCleanup(t *testing.T) {
+	testCases := []struct {
+		name        string
+		mounts      []string // the mounts under the mount point, relative to it
+		fsType      string
+		strayPods   []string
+		removeStray bool
+		cleaned     bool
+	}{
+		{"test without LXCFS left", nil, "", nil, false, true},
+		{"test with LXCFS left", []string{"", ""}, lxcfsFsType, nil, false, true},
+		{"test with other file system mounted", []string{"/proc"}, "tmpfs", nil, false, false},
+		{"test with stray entries mounted by pods", nil, "", []string{"nginx", "redis"}, false, false},
+		{"test with stray entries removed forcibly", nil, "", []string{"nginx"}, true, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+
+		supervisor, mounter := newSupervisorExample(t, "exit 0", testCase.strayPods...)
+		supervisor.removeStray = testCase.removeStray
+		mountPoint := supervisor.agent.source("/")
+		for _, m := range testCase.mounts {
+			mounter.mountTable[300] = append(mounter.mountTable[300], mountInfo{mountPoint: mountPoint + m, fsType: testCase.fsType})
+		}
+		stray := filepath.Join(mountPoint, "proc", "meminfo")
+		if err := os.MkdirAll(stray, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		err := supervisor.cleanup()
+		assert.Equal(t, err == nil, testCase.cleaned, "error: %v", err)
+		_, err = os.Stat(stray)
+		assert.Equal(t, os.IsNotExist(err), testCase.cleaned)
+		if testCase.cleaned {
+			assert.Equal(t, len(mounter.mountTable[300]), 0)
+		}
+		var pods []string
+		for _, pod := range testCase.strayPods {
+			pods = append(pods, "demo/"+pod)
+		}
+		assert.DeepEqual(t, supervisor.currentStatus().StrayPods, pods)
+	}
+}
+
+func TestLxcfsSupervisorRestart(t *testing.T) {
+	supervisor, _ := newSupervisorExample(t, "exit 1")
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		supervisor.run(stopCh)
+		close(done)
+	}()
+
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return supervisor.currentStatus().Restarts >= 3, nil
+	})
+	assert.NilError(t, err)
+	close(stopCh)
+	<-done
+
+	status := supervisor.currentStatus()
+	assert.Equal(t, status.Running, false)
+	assert.Equal(t, status.LastError, "exit status 1")
+}
+
+func TestLxcfsSupervisorReadyz(t *testing.T) {
+	supervisor, mounter := newSupervisorExample(t, "exec sleep 10")
+	readyz := func() int {
+		w := httptest.NewRecorder()
+		supervisor.readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code
+	}
+	assert.Equal(t, readyz(), http.StatusServiceUnavailable)
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		supervisor.run(stopCh)
+		close(done)
+	}()
+
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return supervisor.currentStatus().Running, nil
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, readyz(), http.StatusServiceUnavailable)
+
+	// LXCFS mounted
+	mounter.mu.Lock()
+	mounter.mountTable[300] = append(mounter.mountTable[300], mountInfo{mountPoint: supervisor.agent.source("/"), fsType: lxcfsFsType})
+	mounter.mu.Unlock()
+	assert.Equal(t, readyz(), http.StatusOK)
+
+	w := httptest.NewRecorder()
+	supervisor.statusz(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var status lxcfsStatus
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, status.Running, true)
+	assert.Equal(t, status.Mounted, true)
+	assert.DeepEqual(t, status.Args, []string{"--foreground"})
+
+	close(stopCh)
+	<-done
+	assert.Equal(t, supervisor.currentStatus().Running, false)
+	assert.Equal(t, supervisor.currentStatus().Restarts, 0)
+}
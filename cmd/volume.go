@@ -1,6 +1,13 @@
 package main
 
-import corev1 "k8s.io/api/core/v1"
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+)
 
 // -v /var/lib/lxc/lxcfs/proc/cpuinfo:/proc/cpuinfo:ro
 // -v /var/lib/lxc/lxcfs/proc/diskstats:/proc/diskstats:ro
@@ -14,78 +21,174 @@ import corev1 "k8s.io/api/core/v1"
 
 const lxcfsVol = "lxcfs"
 
-var volumeMountsTemplate = []corev1.VolumeMount{
+const (
+	defaultLxcfsHostRoot = "/var/lib/lxc/"
+	defaultLxcfsMountDir = "lxcfs"
+)
 
-	{
-		Name:      lxcfsVol,
-		MountPath: "/proc/cpuinfo",
-		SubPath:   "lxcfs/proc/cpuinfo",
-		ReadOnly:  true,
-	},
-	{
-		Name:      lxcfsVol,
-		MountPath: "/proc/diskstats",
-		SubPath:   "lxcfs/proc/diskstats",
-		ReadOnly:  true,
-	},
-	{
-		Name:      lxcfsVol,
-		MountPath: "/proc/loadavg",
-		SubPath:   "lxcfs/proc/loadavg",
-		ReadOnly:  true,
-	},
-	{
-		Name:      lxcfsVol,
-		MountPath: "/proc/meminfo",
-		SubPath:   "lxcfs/proc/meminfo",
-		ReadOnly:  true,
-	},
-	{
-		Name:      lxcfsVol,
-		MountPath: "/proc/stat",
-		SubPath:   "lxcfs/proc/stat",
-		ReadOnly:  true,
+const (
+	lxcfsProfileMinimal  = "minimal"
+	lxcfsProfileCPU      = "cpu"
+	lxcfsProfileMemory   = "memory"
+	lxcfsProfilePressure = "pressure"
+	lxcfsProfileFull     = "full"
+)
+
+// broadLxcfsHostRoots the host directories not allowed as the LXCFS host root, the host root is mounted into
+// every mutated container, these contain the runtime sockets or the host configs, which is a container escape
+var broadLxcfsHostRoots = []string{"/", "/dev", "/etc", "/proc", "/root", "/run", "/sys", "/usr", "/var", "/var/lib", "/var/run"}
+
+// the LXCFS version provided by the lxcfs daemonset image, see lxcfs-image/.env
+const defaultLxcfsVersion = "4.0.12"
+
+// lxcfsFile the file provided by LXCFS which can be bind-mounted over container's original
+type lxcfsFile struct {
+	path       string
+	minVersion *version.Version // the LXCFS version start to provide this file, nil means all versions
+	optional   bool             // optional files are not mounted by the full profile
+}
+
+// lxcfsFileCatalogue all the files provided by LXCFS
+var lxcfsFileCatalogue = []lxcfsFile{
+	{path: "/proc/cpuinfo"},
+	{path: "/proc/diskstats"},
+	{path: "/proc/loadavg"},
+	{path: "/proc/meminfo"},
+	{path: "/proc/stat"},
+	{path: "/proc/swaps"},
+	{path: "/proc/uptime"},
+	{path: "/sys/devices/system/cpu/online"},
+	{path: "/proc/slabinfo", minVersion: version.MustParseGeneric("5.0.0"), optional: true},
+	{path: "/proc/pressure/cpu", minVersion: version.MustParseGeneric("5.0.0"), optional: true},
+	{path: "/proc/pressure/io", minVersion: version.MustParseGeneric("5.0.0"), optional: true},
+	{path: "/proc/pressure/memory", minVersion: version.MustParseGeneric("5.0.0"), optional: true},
+	{path: "/sys/devices/system/cpu", minVersion: version.MustParseGeneric("5.0.0"), optional: true},
+}
+
+// lxcfsFiles the LXCFS files mounted by the full profile
+var lxcfsFiles = func() (files []string) {
+	for _, file := range lxcfsFileCatalogue {
+		if !file.optional {
+			files = append(files, file.path)
+		}
+	}
+	return files
+}()
+
+// lxcfsProfiles named LXCFS files set which can be chosen by pod annotation
+var lxcfsProfiles = map[string][]string{
+	lxcfsProfileMinimal: {
+		"/proc/cpuinfo",
+		"/proc/meminfo",
 	},
-	{
-		Name:      lxcfsVol,
-		MountPath: "/proc/swaps",
-		SubPath:   "lxcfs/proc/swaps",
-		ReadOnly:  true,
+	lxcfsProfileCPU: {
+		"/proc/cpuinfo",
+		"/proc/loadavg",
+		"/proc/stat",
+		"/sys/devices/system/cpu/online",
 	},
-	{
-		Name:      lxcfsVol,
-		MountPath: "/proc/uptime",
-		SubPath:   "lxcfs/proc/uptime",
-		ReadOnly:  true,
+	lxcfsProfileMemory: {
+		"/proc/meminfo",
+		"/proc/swaps",
 	},
-	{
-		Name:      lxcfsVol,
-		MountPath: "/sys/devices/system/cpu/online",
-		SubPath:   "lxcfs/sys/devices/system/cpu/online",
-		ReadOnly:  true,
+	lxcfsProfilePressure: {
+		"/proc/pressure/cpu",
+		"/proc/pressure/io",
+		"/proc/pressure/memory",
 	},
-	{
+	lxcfsProfileFull: lxcfsFiles,
+}
+
+// nestedLxcfsFile find the file under another one in files, e.g. /sys/devices/system/cpu/online under
+// /sys/devices/system/cpu, their bind mounts overlap and the file seen depends on the mount order
+func nestedLxcfsFile(files []string) (file, parent string, found bool) {
+	for _, f := range files {
+		for _, p := range files {
+			if strings.HasPrefix(f, strings.TrimSuffix(p, "/")+"/") {
+				return f, p, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// lxcfsFileSupported check whether the file is provided by the LXCFS version
+func lxcfsFileSupported(file string, lxcfsVersion *version.Version) bool {
+	for _, f := range lxcfsFileCatalogue {
+		if f.path != file {
+			continue
+		}
+		return f.minVersion == nil || lxcfsVersion.AtLeast(f.minVersion)
+	}
+	return false
+}
+
+// lxcfsMount where LXCFS is mounted on host, the volumes and volume mounts are built from it
+type lxcfsMount struct {
+	hostRoot string // host directory contains the LXCFS mount point, mounted into container at the same path
+	mountDir string // sub directory of hostRoot where LXCFS is mounted
+	volumes  []corev1.Volume
+}
+
+// newLxcfsMount create lxcfsMount and build the LXCFS volumes of it
+func newLxcfsMount(hostRoot, mountDir string) (*lxcfsMount, error) {
+	if !path.IsAbs(hostRoot) {
+		return nil, fmt.Errorf("LXCFS host root %q is not an absolute path", hostRoot)
+	}
+	for _, root := range broadLxcfsHostRoots {
+		if path.Clean(hostRoot) == root {
+			return nil, fmt.Errorf("LXCFS host root %q is too broad to mount into containers, use a dedicated directory like /run/lxcfs", hostRoot)
+		}
+	}
+	mountDir = path.Clean(mountDir)
+	if path.IsAbs(mountDir) || mountDir == "." || mountDir == ".." || strings.HasPrefix(mountDir, "../") {
+		return nil, fmt.Errorf("LXCFS mount directory %q is not a sub directory of host root", mountDir)
+	}
+
+	m := &lxcfsMount{
+		hostRoot: hostRoot,
+		mountDir: mountDir,
+		volumes: []corev1.Volume{
+			{
+				Name: lxcfsVol,
+				VolumeSource: corev1.VolumeSource{
+					HostPath: &corev1.HostPathVolumeSource{
+						Path: hostRoot,
+						Type: func() *corev1.HostPathType {
+							pt := corev1.HostPathDirectoryOrCreate
+							return &pt
+						}(),
+					},
+				},
+			},
+		},
+	}
+	// Workaround: https://github.com/kubernetes/kubernetes/issues/57982
+	applyDefaultsWorkaround(m.volumes)
+
+	return m, nil
+}
+
+// volumeMounts build volume mounts bind-mount the LXCFS files over container's originals,
+// the whole LXCFS volume is always mounted for remount LXCFS files after LXCFS restart
+func (m *lxcfsMount) volumeMounts(files []string) []corev1.VolumeMount {
+	volumeMounts := make([]corev1.VolumeMount, 0, len(files)+1)
+	for _, file := range files {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      lxcfsVol,
+			MountPath: file,
+			SubPath:   path.Join(m.mountDir, file),
+			ReadOnly:  true,
+		})
+	}
+
+	return append(volumeMounts, corev1.VolumeMount{
 		Name:      lxcfsVol,
-		MountPath: "/var/lib/lxc/",
+		MountPath: m.hostRoot,
 		ReadOnly:  true,
 		MountPropagation: func() *corev1.MountPropagationMode {
 			pt := corev1.MountPropagationHostToContainer
 			return &pt
 		}(),
-	},
-}
-
-var volumesTemplate = []corev1.Volume{
-	{
-		Name: lxcfsVol,
-		VolumeSource: corev1.VolumeSource{
-			HostPath: &corev1.HostPathVolumeSource{
-				Path: "/var/lib/lxc/",
-				Type: func() *corev1.HostPathType {
-					pt := corev1.HostPathDirectoryOrCreate
-					return &pt
-				}(),
-			},
-		},
-	},
+	})
 }
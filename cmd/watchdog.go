@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// lxcfsWatchdog watch the LXCFS mount on host, and repair the LXCFS files lost FUSE connection in containers,
+// which are left by the LXCFS crashed without the pre-stop hook run, and the ones mounted from the stray
+// directories created by kubelet before LXCFS mounted
+type lxcfsWatchdog struct {
+	agent     *lxcfsAgent
+	node      string
+	mounted   *bool               // the LXCFS mount state of the last check, nil before the first check
+	publisher *nodeFilesPublisher // publish the LXCFS files supported by the node once mounted, nil if disabled
+}
+
+// run check every interval until stopCh closed, the CRI runtime requests of each check time out after timeout
+func (w *lxcfsWatchdog) run(interval, timeout time.Duration, stopCh <-chan struct{}) {
+	defaultLogger.info("LXCFS watchdog started", "node", w.node, "interval", interval.String())
+	wait.Until(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		w.check(ctx)
+	}, interval, stopCh)
+}
+
+// check the LXCFS mount and the containers, return the number of containers broken and repaired.
+// The stale and stray files are repaired once LXCFS mounted, and all the files are remounted when LXCFS
+// mounted again, the containers are broken if LXCFS not mounted or failed to repair.
+func (w *lxcfsWatchdog) check(ctx context.Context) (broken, repaired int) {
+	var strayed int
+	unlock, err := w.agent.lockMounts(ctx)
+	if err != nil {
+		defaultLogger.error("Failed to lock LXCFS mounts", "lockFile", w.agent.lockFile, "error", err)
+		return 0, 0
+	}
+	defer unlock()
+
+	mounted, err := w.agent.lxcfsMounted()
+	if err != nil {
+		defaultLogger.error("Failed to check LXCFS mount", "error", err)
+		return 0, 0
+	}
+	switch {
+	case w.mounted == nil:
+		defaultLogger.info("Checked LXCFS mount", "mountPoint", w.agent.source("/"), "mounted", mounted)
+	case *w.mounted && !mounted:
+		defaultLogger.warning("LXCFS unmounted, the LXCFS files in containers are broken until it mounted again", "mountPoint", w.agent.source("/"))
+	case !*w.mounted && mounted:
+		defaultLogger.info("LXCFS mounted again, remount the LXCFS files in containers", "mountPoint", w.agent.source("/"))
+	}
+	remountAll := mounted && (w.mounted == nil || !*w.mounted)
+	w.mounted = &mounted
+	recordLxcfsMounted(w.node, mounted)
+	if mounted && w.publisher != nil {
+		files := w.agent.supportedFiles()
+		if published, err := w.publisher.publish(ctx, files); err != nil {
+			defaultLogger.warning("Failed to publish LXCFS files supported by the node", "node", w.node, "error", err)
+		} else if published {
+			defaultLogger.info("Published LXCFS files supported by the node", "node", w.node, "files", strings.Join(files, ","), "cgroupMode", w.publisher.cgroupMode)
+		}
+	}
+
+	containers, err := lxcfsContainers(ctx, w.agent.runtime, w.agent.lxcfsPods, w.agent.mount, w.agent.annotationPrefix)
+	if err != nil {
+		defaultLogger.warning("Failed to list some containers", "error", err)
+	}
+	for _, c := range containers {
+		log := defaultLogger.with("namespace", c.podNamespace, "pod", c.podName, "container", c.name, "pid", c.pid)
+
+		stale, err := w.agent.staleFiles(c)
+		if err != nil {
+			log.warning("Failed to check LXCFS mounts in container", "error", err)
+			continue
+		}
+		stray, err := w.agent.strayFiles(c)
+		if err != nil {
+			log.warning("Failed to check LXCFS mounts in container", "error", err)
+			continue
+		}
+		if len(stray) > 0 {
+			log.warning("LXCFS files in container are stray directories created before LXCFS mounted", "files", strings.Join(stray, ","))
+			strayed++
+		}
+		// the LXCFS files of the ephemeral containers are mounted by the agent only, the other containers
+		// miss them only if unmounted before LXCFS stopped, they are remounted once LXCFS mounted again
+		var missing []string
+		if c.ephemeral {
+			if missing, err = w.agent.missingFiles(c); err != nil {
+				log.warning("Failed to check LXCFS mounts in container", "error", err)
+				continue
+			}
+		}
+		if !mounted {
+			if len(stale) > 0 || len(stray) > 0 || len(missing) > 0 {
+				broken++
+			}
+			continue
+		}
+		if len(stale) == 0 && len(stray) == 0 && len(missing) == 0 && !remountAll {
+			continue
+		}
+
+		files, err := w.agent.remount(c)
+		if err != nil {
+			log.warning("Failed to repair LXCFS mounts in container", "error", err)
+			broken++
+			continue
+		}
+		if len(files) > 0 {
+			log.info("Repaired LXCFS mounts in container", "files", strings.Join(files, ","))
+			repaired++
+		}
+	}
+
+	recordWatchdogCheck(w.node, broken, repaired, strayed)
+	return broken, repaired
+}
+
+// runWatchdog run the watchdog and serve its metrics on metricsPort until SIGINT or SIGTERM received,
+// the metrics are not served if metricsPort is 0
+func runWatchdog(w *lxcfsWatchdog, interval, timeout time.Duration, metricsPort int) error {
+	if metricsPort != 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(agentRegistry, promhttp.HandlerOpts{}))
+		server := &http.Server{Addr: fmt.Sprintf(":%v", metricsPort), Handler: mux}
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+		go func() {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				defaultLogger.error("Failed to serve agent metrics", "error", err)
+			}
+		}()
+	}
+
+	stopCh := make(chan struct{})
+	go w.run(interval, timeout, stopCh)
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	<-signalChan
+	defaultLogger.info("Got OS shutdown signal, stopping LXCFS watchdog")
+	close(stopCh)
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/fake"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestLxcfsWatchdog(t *testing.T) {
+	service := &fakeRuntimeService{
+		sandboxes: []*runtimeapi.PodSandbox{{
+			Id:       "nginx",
+			Metadata: &runtimeapi.PodSandboxMetadata{Namespace: "demo", Name: "nginx"},
+			State:    runtimeapi.PodSandboxState_SANDBOX_READY,
+			Annotations: map[string]string{
+				admissionWebhookAnnotationStatusKey:       admissionWebhookSuccessFlag,
+				admissionWebhookAnnotationMutatedFilesKey: "/proc/meminfo",
+			},
+		}},
+		statuses: make(map[string]*runtimeapi.ContainerStatusResponse),
+	}
+	service.addContainer("nginx", "nginx", 100, "/var/lib/lxc/", "/proc/meminfo")
+
+	mount, err := newLxcfsMount(defaultLxcfsHostRoot, defaultLxcfsMountDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounter := &fakeMounter{
+		mountTable: map[int][]mountInfo{
+			100: {{"/proc/meminfo", "proc", "/"}, {"/proc/meminfo", lxcfsFsType, "/proc/meminfo"}},
+			300: {{"/var/lib/lxc/lxcfs", lxcfsFsType, "/"}},
+		},
+		stale:  map[int]map[string]int{100: {}},
+		source: "/var/lib/lxc/lxcfs",
+	}
+	watchdog := &lxcfsWatchdog{
+		agent: &lxcfsAgent{
+			runtime:   startFakeRuntimeService(t, service),
+			mounter:   mounter,
+			mount:     mount,
+			lxcfsPods: labels.SelectorFromSet(labels.Set{"app": "lxcfs-ds"}),
+			pid:       300,
+		},
+		node:      "node1",
+		publisher: &nodeFilesPublisher{client: fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}), node: "node1", cgroupMode: cgroupModeV1},
+	}
+
+	testCases := []struct {
+		name     string
+		lxcfsUp  bool
+		stale    int  // the stale mounts of /proc/meminfo
+		stray    bool // mount the stray directory created by kubelet at /proc/meminfo
+		broken   int
+		repaired int
+		strayed  int
+	}{
+		{"test with LXCFS mounted", true, 0, false, 0, 0, 0},
+		{"test with LXCFS crashed", false, 1, false, 1, 0, 0},
+		{"test with LXCFS still down", false, 1, false, 1, 0, 0},
+		{"test with LXCFS mounted again", true, 1, false, 0, 1, 0},
+		{"test with containers repaired", true, 0, false, 0, 0, 0},
+		{"test with stray directory before LXCFS mounted", false, 0, true, 1, 0, 1},
+		{"test with stray directory repaired", true, 0, false, 0, 1, 1},
+		{"test with stray directory removed", true, 0, false, 0, 0, 0},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+
+		mounter.lxcfsUp = testCase.lxcfsUp
+		mounter.stale[100]["/proc/meminfo"] = testCase.stale
+		if testCase.stray {
+			mounter.mountTable[100] = append(mounter.mountTable[100], mountInfo{"/proc/meminfo", "ext4", "/var/lib/lxc/lxcfs/proc/meminfo"})
+		}
+		repairedTotal := testutil.ToFloat64(agentRepairedContainers.WithLabelValues("node1"))
+
+		broken, repaired := watchdog.check(context.Background())
+		assert.Equal(t, broken, testCase.broken)
+		assert.Equal(t, repaired, testCase.repaired)
+		assert.Equal(t, testutil.ToFloat64(agentBrokenContainers.WithLabelValues("node1")), float64(testCase.broken))
+		assert.Equal(t, testutil.ToFloat64(agentStrayContainers.WithLabelValues("node1")), float64(testCase.strayed))
+		assert.Equal(t, testutil.ToFloat64(agentRepairedContainers.WithLabelValues("node1")), repairedTotal+float64(testCase.repaired))
+		assert.Equal(t, testutil.ToFloat64(agentLxcfsMounted.WithLabelValues("node1")) == 1, testCase.lxcfsUp)
+		assert.DeepEqual(t, mounter.lxcfsFilesMounted(100), []string{"/proc/meminfo"})
+	}
+	assert.Equal(t, len(mounter.mountTable[100]), 2)
+
+	// the LXCFS files supported are published once mounted
+	node, err := watchdog.publisher.client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, node.Annotations[lxcfsFilesNodeAnnotation], strings.Join(catalogueFiles(), ","))
+	assert.Equal(t, node.Annotations[cgroupModeNodeAnnotation], cgroupModeV1)
+}
+
+func TestLxcfsWatchdogEphemeralContainer(t *testing.T) {
+	service := &fakeRuntimeService{
+		sandboxes: []*runtimeapi.PodSandbox{{
+			Id:       "nginx",
+			Metadata: &runtimeapi.PodSandboxMetadata{Namespace: "demo", Name: "nginx"},
+			State:    runtimeapi.PodSandboxState_SANDBOX_READY,
+			Annotations: map[string]string{
+				admissionWebhookAnnotationStatusKey:            admissionWebhookSuccessFlag,
+				admissionWebhookAnnotationMutatedContainersKey: "nginx",
+				admissionWebhookAnnotationMutatedFilesKey:      "/proc/meminfo",
+			},
+		}},
+		statuses: make(map[string]*runtimeapi.ContainerStatusResponse),
+	}
+	service.addContainer("nginx", "nginx", 100, "/var/lib/lxc/", "/proc/meminfo")
+	service.addContainer("nginx", "debugger", 101, "/var/lib/lxc/")
+
+	mount, err := newLxcfsMount(defaultLxcfsHostRoot, defaultLxcfsMountDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounter := &fakeMounter{
+		mountTable: map[int][]mountInfo{
+			100: {{"/proc/meminfo", "proc", "/"}, {"/proc/meminfo", lxcfsFsType, "/proc/meminfo"}},
+			101: {{"/proc/meminfo", "proc", "/"}},
+			300: {{"/var/lib/lxc/lxcfs", lxcfsFsType, "/"}},
+		},
+		stale:  map[int]map[string]int{},
+		source: "/var/lib/lxc/lxcfs",
+	}
+	watchdog := &lxcfsWatchdog{
+		agent: &lxcfsAgent{
+			runtime:   startFakeRuntimeService(t, service),
+			mounter:   mounter,
+			mount:     mount,
+			lxcfsPods: labels.SelectorFromSet(labels.Set{"app": "lxcfs-ds"}),
+			pid:       300,
+		},
+		node: "node1",
+	}
+
+	testCases := []struct {
+		name     string
+		lxcfsUp  bool
+		broken   int
+		repaired int
+		mounted  []string // the LXCFS files mounted in the ephemeral container
+	}{
+		{"test with LXCFS down", false, 1, 0, []string{}},
+		{"test with LXCFS mounted", true, 0, 1, []string{"/proc/meminfo"}},
+		{"test with ephemeral container mounted", true, 0, 0, []string{"/proc/meminfo"}},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+
+		mounter.lxcfsUp = testCase.lxcfsUp
+		broken, repaired := watchdog.check(context.Background())
+		assert.Equal(t, broken, testCase.broken)
+		assert.Equal(t, repaired, testCase.repaired)
+		assert.DeepEqual(t, mounter.lxcfsFilesMounted(101), testCase.mounted)
+	}
+}
@@ -5,15 +5,18 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/golang/glog"
 	admissionv1 "k8s.io/api/admission/v1"
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/version"
 	"k8s.io/kubernetes/pkg/apis/core/v1"
 )
 
@@ -47,24 +50,80 @@ const (
 	admissionWebhookAnnotationEnableKey = "mutating.lxcfs-admission-webhook.io/enable"
 	admissionWebhookAnnotationStatusKey = "mutating.lxcfs-admission-webhook.io/status"
 
+	admissionWebhookAnnotationInitContainersKey    = "mutating.lxcfs-admission-webhook.io/init-containers"
+	admissionWebhookAnnotationIncludeContainersKey = "mutating.lxcfs-admission-webhook.io/include-containers"
+	admissionWebhookAnnotationExcludeContainersKey = "mutating.lxcfs-admission-webhook.io/exclude-containers"
+	admissionWebhookAnnotationMutatedContainersKey = "mutating.lxcfs-admission-webhook.io/mutated-containers"
+	admissionWebhookAnnotationProfileKey           = "mutating.lxcfs-admission-webhook.io/profile"
+	admissionWebhookAnnotationFilesKey             = "mutating.lxcfs-admission-webhook.io/files"
+	admissionWebhookAnnotationMutatedFilesKey      = "mutating.lxcfs-admission-webhook.io/mutated-files"
+	admissionWebhookAnnotationConflictStrategyKey  = "mutating.lxcfs-admission-webhook.io/conflict-strategy"
+	admissionWebhookAnnotationConflictsKey         = "mutating.lxcfs-admission-webhook.io/conflicts"
+
 	admissionWebhookSuccessFlag  = "mutated"
 	admissionWebhookConflictFlag = "conflict"
 	admissionWebhookSkipFlag     = "skip"
 
+	ephemeralContainersSubResource = "ephemeralcontainers"
+
 	admissionWebhookResponseAPIVersion = "admission.k8s.io/v1"
 	admissionWebhookResponseKind       = "AdmissionReview"
 )
 
 // WebhookServer lxcfs admission webhook server
 type WebhookServer struct {
-	server *http.Server
+	server      *http.Server
+	probeServer *http.Server // serve the probes in plain HTTP, nil if probes served by server
+	certificate certificateProvider
+	namespaces  *namespaceWatcher   // provide the default annotations of pods, nil if disabled
+	policies    *lxcfsPolicyWatcher // provide the LxcfsPolicy matching pods, nil if disabled
+	nodeFiles   *nodeFilesWatcher   // provide the LXCFS files supported by the nodes, nil if disabled
+	policy      atomic.Value        // *webhookPolicy in use, replaced when config file reloaded
+	configValid int32               // set to 1 once a valid config loaded, the last good one is kept if reload failed
+	shutdown    int32               // set to 1 once server shutdown started
 }
 
 // WhSvrParameters webhook server parameters
 type WhSvrParameters struct {
-	port     int    // webhook server port
-	certFile string // path to the x509 certificate for https
-	keyFile  string // path to the x509 private key matching `CertFile`
+	port      int    // webhook server port
+	probePort int    // plain HTTP port for probes and version, 0 to serve them on port
+	certFile  string // path to the x509 certificate for https
+	keyFile   string // path to the x509 private key matching `CertFile`
+
+	mode             string // policy mode, enforce or audit
+	conflictStrategy string // default strategy to resolve the volume mount conflicts
+	mutateWorkloads  bool   // mutate the pod template of workloads
+	nodeAffinity     bool   // add node affinity to the mutated pods, requires the node controller
+	lxcfsVersion     string // LXCFS version in use, gate the LXCFS files can be mounted
+	lxcfsHostRoot    string // host directory contains the LXCFS mount point
+	lxcfsMountDir    string // sub directory of lxcfsHostRoot where LXCFS is mounted
+
+	readinessGuard              bool          // prepend the init container waits for LXCFS ready to the mutated pods
+	readinessGuardImage         string        // image of the readiness guard, provides sh, grep and head
+	readinessGuardTimeout       time.Duration // time to wait for LXCFS ready
+	readinessGuardFailurePolicy string        // Fail or Ignore when the readiness guard timed out
+
+	configFile string // path to the webhook policy config file, override the parameters above
+
+	namespaceDefaults bool // watch namespaces and default the pod annotations by the namespace annotations
+	lxcfsPolicies     bool // watch LxcfsPolicy and default the pod annotations by the best matching policy
+
+	nodeController   bool   // label the nodes where the LXCFS DaemonSet pod is ready
+	nodeFiles        bool   // watch the LXCFS files supported by the nodes, published by the node agent
+	lxcfsPodSelector string // label selector of the LXCFS DaemonSet pods in namespace
+
+	selfManagedCert   bool   // generate certificate in secret and patch caBundle, instead of certFile and keyFile
+	kubeconfig        string // path to kubeconfig, in-cluster config is used if empty
+	namespace         string // namespace of the webhook service, the certificate secret and the LXCFS DaemonSet
+	serviceName       string // webhook service name, the DNS names of the certificate
+	certSecret        string // secret name stores the self-managed certificate
+	webhookConfigName string // MutatingWebhookConfiguration name to patch caBundle
+}
+
+// podContainer container of the pod to be mutated with its JSON pointer path
+type podContainer struct {
+	path      string // JSON pointer path of the container, e.g. /spec/containers/0
+	container *corev1.Container
 }
 
 type patchOperation struct {
@@ -90,19 +149,25 @@ func applyDefaultsWorkaround(volumes []corev1.Volume) {
 	})
 }
 
+// isDryRun check whether the admission request is a dry run, e.g. kubectl apply --dry-run=server,
+// the patch is still returned to show the mutation, but it's not counted as a real admission
+func isDryRun(admissionRequest *admissionv1.AdmissionRequest) bool {
+	return admissionRequest.DryRun != nil && *admissionRequest.DryRun
+}
+
 // Check whether the target resoured need to be mutated
-func mutationRequired(ignoredNSList []string, validKindList []metav1.GroupVersionKind, validOperationList []admissionv1.Operation, admissionReview *admissionv1.AdmissionReview) bool {
+func mutationRequired(log *logger, policy *webhookPolicy, validKindList []metav1.GroupVersionKind, validOperationList []admissionv1.Operation, admissionReview *admissionv1.AdmissionReview, defaults map[string]string) bool {
 	admissionRequest := admissionReview.Request
 
-	var pod corev1.Pod
-	if err := json.Unmarshal(admissionRequest.Object.Raw, &pod); err != nil {
+	pod, _, err := podFromObject(admissionRequest)
+	if err != nil {
 		return false
 	}
 
 	// skip special kubernete system namespaces
-	for _, namespace := range ignoredNSList {
+	for _, namespace := range policy.IgnoredNamespaces {
 		if admissionRequest.Namespace == namespace {
-			glog.Infof("Skip mutation for %v for it's in special namespace: %v", pod.GenerateName, admissionRequest.Namespace)
+			log.info("Skip mutation for it's in special namespace")
 			return false
 		}
 	}
@@ -130,7 +195,7 @@ func mutationRequired(ignoredNSList []string, validKindList []metav1.GroupVersio
 		return false
 	}
 
-	annotations := pod.GetAnnotations()
+	annotations := annotationDefaults(policy.importAnnotations(pod.GetAnnotations()), defaults)
 	if annotations == nil {
 		annotations = map[string]string{}
 	}
@@ -150,10 +215,208 @@ func mutationRequired(ignoredNSList []string, validKindList []metav1.GroupVersio
 		}
 	}
 
-	glog.Infof("Mutation policy for %v/%v: status: %q required:%v", admissionRequest.Namespace, pod.GenerateName, status, required)
+	log.info("Mutation policy", "status", status, "required", required)
+	return required
+}
+
+// Check whether the ephemeral containers of target pod need to be mutated,
+// only the pod already mutated has the LXCFS volume which ephemeral containers can mount
+func ephemeralContainersMutationRequired(log *logger, policy *webhookPolicy, admissionReview *admissionv1.AdmissionReview) bool {
+	admissionRequest := admissionReview.Request
+
+	if admissionRequest.Operation != admissionv1.Update || admissionRequest.SubResource != ephemeralContainersSubResource {
+		return false
+	}
+
+	var pod corev1.Pod
+	if err := json.Unmarshal(admissionRequest.Object.Raw, &pod); err != nil {
+		return false
+	}
+
+	// skip special kubernete system namespaces
+	for _, namespace := range policy.IgnoredNamespaces {
+		if admissionRequest.Namespace == namespace {
+			log.info("Skip ephemeral containers mutation for it's in special namespace")
+			return false
+		}
+	}
+
+	// verify the kind got
+	validKind := false
+	for _, kind := range policy.MutatingKinds {
+		if admissionRequest.Kind == kind {
+			validKind = true
+		}
+	}
+	if !validKind {
+		return false
+	}
+
+	status := policy.importAnnotations(pod.GetAnnotations())[admissionWebhookAnnotationStatusKey]
+	hasVolume := volumeConflictCheck(pod.Spec.Volumes, []corev1.Volume{{Name: lxcfsVol}})
+	required := strings.ToLower(status) == admissionWebhookSuccessFlag && hasVolume
+
+	log.info("Ephemeral containers mutation policy", "status", status, "volume", hasVolume, "required", required)
 	return required
 }
 
+// initContainersMutationRequired check whether the init containers of pod should be mutated too,
+// init containers are not mutated unless the annotation enable it explicitly
+func initContainersMutationRequired(annotations map[string]string) bool {
+	switch strings.ToLower(annotations[admissionWebhookAnnotationInitContainersKey]) {
+	case "y", "yes", "true", "on":
+		return true
+	default:
+		return false
+	}
+}
+
+// annotationList split the comma separated annotation value to a name set
+func annotationList(annotations map[string]string, key string) map[string]bool {
+	value, ok := annotations[key]
+	if !ok {
+		return nil
+	}
+
+	names := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// containerSelected check whether the container selected by the include and exclude containers annotation,
+// all containers are included if include containers annotation not set
+func containerSelected(name string, included, excluded map[string]bool) bool {
+	if included != nil && !included[name] {
+		return false
+	}
+	return !excluded[name]
+}
+
+// mutatingContainers get the containers of pod which need to mount LXCFS files
+func mutatingContainers(pod *corev1.Pod) (containers []podContainer) {
+	included := annotationList(pod.Annotations, admissionWebhookAnnotationIncludeContainersKey)
+	excluded := annotationList(pod.Annotations, admissionWebhookAnnotationExcludeContainersKey)
+
+	if initContainersMutationRequired(pod.Annotations) {
+		for idx := range pod.Spec.InitContainers {
+			if !containerSelected(pod.Spec.InitContainers[idx].Name, included, excluded) {
+				continue
+			}
+			containers = append(containers, podContainer{
+				path:      fmt.Sprintf("/spec/initContainers/%d", idx),
+				container: &pod.Spec.InitContainers[idx],
+			})
+		}
+	}
+	for idx := range pod.Spec.Containers {
+		if !containerSelected(pod.Spec.Containers[idx].Name, included, excluded) {
+			continue
+		}
+		containers = append(containers, podContainer{
+			path:      fmt.Sprintf("/spec/containers/%d", idx),
+			container: &pod.Spec.Containers[idx],
+		})
+	}
+	return containers
+}
+
+// lxcfsFilesRequired get the LXCFS files to mount chosen by the pod annotations,
+// the explicit files list take precedence over the profile, use defaultProfile if neither set,
+// the files must be provided by the LXCFS version, profiles is the named LXCFS files sets can be chosen
+func lxcfsFilesRequired(annotations map[string]string, profiles map[string][]string, defaultProfile string, lxcfsVersion *version.Version) ([]string, error) {
+	if lxcfsVersion == nil {
+		lxcfsVersion = version.MustParseGeneric(defaultLxcfsVersion)
+	}
+
+	if value, ok := annotations[admissionWebhookAnnotationFilesKey]; ok {
+		var files []string
+		seen := make(map[string]bool)
+		for _, file := range strings.Split(value, ",") {
+			file = strings.TrimSpace(file)
+			if file == "" || seen[file] {
+				continue
+			}
+			if !lxcfsFileSupported(file, lxcfsVersion) {
+				return nil, fmt.Errorf("unsupported LXCFS file %q by LXCFS version %v", file, lxcfsVersion)
+			}
+			seen[file] = true
+			files = append(files, file)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no LXCFS file specified by annotation %s", admissionWebhookAnnotationFilesKey)
+		}
+		if file, parent, found := nestedLxcfsFile(files); found {
+			return nil, fmt.Errorf("LXCFS file %q is under %q, only one of them can be mounted", file, parent)
+		}
+		return files, nil
+	}
+
+	profile := strings.ToLower(strings.TrimSpace(annotations[admissionWebhookAnnotationProfileKey]))
+	if profile == "" {
+		profile = defaultProfile
+	}
+	files, ok := profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown LXCFS profile %q", profile)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no LXCFS file in profile %q", profile)
+	}
+	for _, file := range files {
+		if !lxcfsFileSupported(file, lxcfsVersion) {
+			return nil, fmt.Errorf("LXCFS profile %q unsupported by LXCFS version %v", profile, lxcfsVersion)
+		}
+	}
+	if file, parent, found := nestedLxcfsFile(files); found {
+		return nil, fmt.Errorf("LXCFS file %q is under %q in profile %q, only one of them can be mounted", file, parent, profile)
+	}
+	return files, nil
+}
+
+// containerNames get the comma separated names of containers
+func containerNames(containers []podContainer) string {
+	names := make([]string, 0, len(containers))
+	for _, c := range containers {
+		names = append(names, c.container.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// newEphemeralContainers get the ephemeral containers of pod which not exist in oldPod
+func newEphemeralContainers(pod, oldPod *corev1.Pod) (containers []podContainer) {
+	existed := make(map[string]bool)
+	for _, ec := range oldPod.Spec.EphemeralContainers {
+		existed[ec.Name] = true
+	}
+
+	for idx, ec := range pod.Spec.EphemeralContainers {
+		if existed[ec.Name] {
+			continue
+		}
+		container := corev1.Container(ec.EphemeralContainerCommon)
+		containers = append(containers, podContainer{
+			path:      fmt.Sprintf("/spec/ephemeralContainers/%d", idx),
+			container: &container,
+		})
+	}
+	return containers
+}
+
+// ephemeralVolumeMounts filter volume mounts which can be used by ephemeral containers,
+// SubPath is forbidden for ephemeral containers by kubernetes API
+func ephemeralVolumeMounts(volumeMounts []corev1.VolumeMount) (mounts []corev1.VolumeMount) {
+	for _, volumeMount := range volumeMounts {
+		if volumeMount.SubPath == "" && volumeMount.SubPathExpr == "" {
+			mounts = append(mounts, volumeMount)
+		}
+	}
+	return mounts
+}
+
 // volumeMountConflictCheck check VolumeMount of target and added has same Name or MountPath
 func volumeMountConflictCheck(target, added []corev1.VolumeMount) bool {
 	for _, origin := range target {
@@ -178,9 +441,13 @@ func volumeConflictCheck(target, added []corev1.Volume) bool {
 	return false
 }
 
-func patchVolumeMount(target, added []corev1.VolumeMount, targetIndex int) (patches []patchOperation) {
+func patchVolumeMount(target, added []corev1.VolumeMount, containerPath string) (patches []patchOperation) {
+	if len(added) == 0 {
+		return nil
+	}
+
 	if len(target) == 0 {
-		path := fmt.Sprintf("/spec/containers/%d/volumeMounts", targetIndex)
+		path := containerPath + "/volumeMounts"
 		op := patchOperation{
 			Op:    "add",
 			Path:  path,
@@ -188,7 +455,7 @@ func patchVolumeMount(target, added []corev1.VolumeMount, targetIndex int) (patc
 		}
 		patches = append(patches, op)
 	} else {
-		path := fmt.Sprintf("/spec/containers/%d/volumeMounts/-", targetIndex)
+		path := containerPath + "/volumeMounts/-"
 		for _, volumeMount := range added {
 			op := patchOperation{
 				Op:    "add",
@@ -201,7 +468,29 @@ func patchVolumeMount(target, added []corev1.VolumeMount, targetIndex int) (patc
 	return patches
 }
 
+func patchReplacedVolumeMount(replaced map[int]corev1.VolumeMount, containerPath string) (patches []patchOperation) {
+	indexes := make([]int, 0, len(replaced))
+	for idx := range replaced {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+
+	for _, idx := range indexes {
+		op := patchOperation{
+			Op:    "replace",
+			Path:  fmt.Sprintf("%s/volumeMounts/%d", containerPath, idx),
+			Value: replaced[idx],
+		}
+		patches = append(patches, op)
+	}
+	return patches
+}
+
 func patchVolume(target, added []corev1.Volume) (patches []patchOperation) {
+	if len(added) == 0 {
+		return nil
+	}
+
 	if len(target) == 0 {
 		op := patchOperation{
 			Op:    "add",
@@ -223,23 +512,36 @@ func patchVolume(target, added []corev1.Volume) (patches []patchOperation) {
 }
 
 func patchAnnotation(target, added map[string]string) (patches []patchOperation) {
-	for key, value := range added {
-		var op = patchOperation{
-			Op:   "add",
-			Path: "/metadata/annotations",
-			Value: map[string]string{
-				key: value,
-			},
-		}
+	if len(added) == 0 {
+		return nil
+	}
 
-		if target != nil {
-			if _, ok := target[key]; ok {
-				op.Op = "replace"
-				op.Path = "/metadata/annotations/" + escapeJSONPointerValue(key)
-				op.Value = value
-			}
+	// add all annotations at once, for add operation with path
+	// /metadata/annotations will replace the whole annotations map
+	if target == nil {
+		op := patchOperation{
+			Op:    "add",
+			Path:  "/metadata/annotations",
+			Value: added,
 		}
+		return append(patches, op)
+	}
 
+	keys := make([]string, 0, len(added))
+	for key := range added {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var op = patchOperation{
+			Op:    "add",
+			Path:  "/metadata/annotations/" + escapeJSONPointerValue(key),
+			Value: added[key],
+		}
+		if _, ok := target[key]; ok {
+			op.Op = "replace"
+		}
 		patches = append(patches, op)
 	}
 	return patches
@@ -250,28 +552,25 @@ func escapeJSONPointerValue(in string) string {
 	return strings.Replace(step, "/", "~1", -1)
 }
 
-func patchConflictCheck(pod *corev1.Pod, volumesTemplate []corev1.Volume, volumeMountsTemplate []corev1.VolumeMount) bool {
-	containers := pod.Spec.Containers
-	for _, container := range containers {
-		if volumeMountConflictCheck(container.VolumeMounts, volumeMountsTemplate) {
-			return true
-		}
-	}
-
-	return volumeConflictCheck(pod.Spec.Volumes, volumesTemplate)
-}
-
 // create mutation patch for resoures
-func createPatch(pod *corev1.Pod, volumesTemplate []corev1.Volume, volumeMountsTemplate []corev1.VolumeMount, annotations map[string]string) ([]byte, error) {
+// basePath is the JSON pointer path of the pod in the resource, empty for pod and the pod template path for workloads
+// readinessGuard is prepended to the init containers if not nil, after the volume mounts of init containers patched
+func createPatch(pod *corev1.Pod, basePath string, volumesTemplate []corev1.Volume, containerMounts []containerVolumeMounts, readinessGuard *corev1.Container, nodeRequirement *corev1.NodeSelectorRequirement, annotations map[string]string) ([]byte, error) {
 	var patches []patchOperation
 
-	containers := pod.Spec.Containers
-	for idx, container := range containers {
-		patches = append(patches, patchVolumeMount(container.VolumeMounts, volumeMountsTemplate, idx)...)
+	for _, c := range containerMounts {
+		patches = append(patches, patchReplacedVolumeMount(c.replaced, c.path)...)
+		patches = append(patches, patchVolumeMount(c.container.VolumeMounts, c.added, c.path)...)
 	}
+	patches = append(patches, patchReadinessGuard(pod.Spec.InitContainers, readinessGuard)...)
 	patches = append(patches, patchVolume(pod.Spec.Volumes, volumesTemplate)...)
+	patches = append(patches, patchNodeAffinity(pod, nodeRequirement)...)
 	patches = append(patches, patchAnnotation(pod.Annotations, annotations)...)
 
+	for idx := range patches {
+		patches[idx].Path = basePath + patches[idx].Path
+	}
+
 	return json.Marshal(patches)
 }
 
@@ -279,9 +578,17 @@ func createPatch(pod *corev1.Pod, volumesTemplate []corev1.Volume, volumeMountsT
 func (whsvr *WebhookServer) mutate(admissionReview *admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
 	admissionRequest := admissionReview.Request
 
-	var pod corev1.Pod
-	if err := json.Unmarshal(admissionRequest.Object.Raw, &pod); err != nil {
-		glog.Errorf("Could not unmarshal raw object: %v", err)
+	// the decision is written in the last log line of the request
+	log := newAdmissionLogger(admissionRequest)
+	defer func() {
+		log.record(admissionRequest.Namespace)
+		log.decided()
+	}()
+
+	pod, basePath, err := podFromObject(admissionRequest)
+	if err != nil {
+		log.error("Could not unmarshal raw object", "error", err)
+		log.decide(outcomeDecodeError, "")
 		return &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
@@ -289,28 +596,173 @@ func (whsvr *WebhookServer) mutate(admissionReview *admissionv1.AdmissionReview)
 		}
 	}
 
-	glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
-		admissionRequest.Kind, admissionRequest.Namespace, admissionRequest.Name, pod.GenerateName, admissionRequest.UID, admissionRequest.Operation, admissionRequest.UserInfo)
+	log.logger = log.with("generateName", pod.GenerateName)
+	log.info("AdmissionReview", "subResource", admissionRequest.SubResource, "user", admissionRequest.UserInfo.Username)
+
+	// the same policy is used during the whole request even if config reloaded
+	policy := whsvr.currentPolicy()
+	audit := policy.auditRequired(admissionRequest.Namespace)
+	if audit {
+		log.audit()
+	}
+
+	if admissionRequest.SubResource == ephemeralContainersSubResource {
+		return whsvr.mutateEphemeralContainers(log, policy, admissionReview, pod)
+	}
+
+	kindList, operationList := policy.MutatingKinds, policy.MutatingOperations
+	if isWorkloadKind(admissionRequest.Kind) {
+		if !policy.MutateWorkloads {
+			log.info("Skipping mutation due to mutating workloads disabled")
+			log.decide(admissionWebhookSkipFlag, skipReasonWorkloadsDisabled)
+			return &admissionv1.AdmissionResponse{Allowed: true}
+		}
+		kindList, operationList = workloadKinds(), validWorkloadOperationList
+	}
+
+	// the annotations with configured prefix are read by the default keys, and defaulted by the namespace annotations,
+	// the original pod is kept to patch annotations
+	// the LxcfsPolicy matching the pod takes precedence over the namespace annotations
+	defaults := policy.importAnnotations(whsvr.namespaces.defaults(admissionRequest.Namespace))
+	matched := whsvr.policies.match(log.logger, admissionRequest.Namespace, pod.Labels)
+	if matched != nil {
+		log.logger = log.with("policy", matched.policyName())
+		defaults = annotationDefaults(matched.annotations(), defaults)
+	}
+	importedPod := *pod
+	importedPod.Annotations = annotationDefaults(policy.importAnnotations(pod.Annotations), defaults)
+
+	// pods created from a mutated pod template, or the mutated pod template itself, should not be patched twice
+	if strings.ToLower(importedPod.Annotations[admissionWebhookAnnotationStatusKey]) == admissionWebhookSuccessFlag {
+		log.info("Skipping mutation due to already mutated")
+		log.decide(admissionWebhookSkipFlag, skipReasonAlreadyMutated)
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
 
-	// Workaround: https://github.com/kubernetes/kubernetes/issues/57982
-	applyDefaultsWorkaround(volumesTemplate)
 	var annotations = make(map[string]string)
+	var skipReason string
 	var volumesTemplateToPatch []corev1.Volume
-	var volumeMountsTemplateToPatch []corev1.VolumeMount
+	var volumeMountsToPatch []containerVolumeMounts
+	var nodeRequirementToPatch *corev1.NodeSelectorRequirement
+	var readinessGuardToPatch *corev1.Container
+
+	// the supported profile of the nodes the pod can be scheduled to is the default if the node files watched
+	var nodeRequirement *corev1.NodeSelectorRequirement
+	if policy.NodeAffinity {
+		nodeRequirement = &lxcfsNodeRequirement
+	}
+	profiles, defaultProfile := whsvr.nodeFiles.profiles(policy.profiles, &importedPod, nodeRequirement)
+	files, filesErr := lxcfsFilesRequired(importedPod.Annotations, profiles, defaultProfile, policy.lxcfsVersion)
+	strategy, strategyErr := conflictStrategyRequired(importedPod.Annotations, policy.ConflictStrategy)
 
-	if !mutationRequired(ignoredNamespaces, validMutatingKindList, validMutatingOperationList, admissionReview) {
-		glog.Infof("Skipping mutation for %s/%s, UID=%s due to policy check", admissionRequest.Namespace, pod.GenerateName, admissionRequest.UID)
+	if !mutationRequired(log.logger, policy, kindList, operationList, admissionReview, defaults) {
+		log.info("Skipping mutation due to policy check")
+		annotations[admissionWebhookAnnotationStatusKey] = admissionWebhookSkipFlag
+		skipReason = skipReasonPolicy
+	} else if len(mutatingContainers(&importedPod)) == 0 {
+		log.info("Skipping mutation due to no container selected")
+		annotations[admissionWebhookAnnotationStatusKey] = admissionWebhookSkipFlag
+		skipReason = skipReasonNoContainer
+	} else if filesErr != nil {
+		log.info("Skipping mutation due to invalid LXCFS files", "error", filesErr)
 		annotations[admissionWebhookAnnotationStatusKey] = admissionWebhookSkipFlag
-	} else if patchConflictCheck(&pod, volumesTemplate, volumeMountsTemplate) {
-		glog.Infof("Skipping mutation for %s/%s, UID=%s due to volume or volume mount conflict", admissionRequest.Namespace, pod.GenerateName, admissionRequest.UID)
+		skipReason = skipReasonInvalidFiles
+	} else if strategyErr != nil {
+		log.info("Skipping mutation due to invalid conflict strategy", "error", strategyErr)
+		annotations[admissionWebhookAnnotationStatusKey] = admissionWebhookSkipFlag
+		skipReason = skipReasonInvalidStrategy
+	} else if mounts, conflicts, conflict := patchConflictCheck(&importedPod, policy.lxcfs.volumes, policy.lxcfs.volumeMounts(files), strategy); conflict {
+		log.info("Skipping mutation due to volume or volume mount conflict")
 		annotations[admissionWebhookAnnotationStatusKey] = admissionWebhookConflictFlag
+		annotations[admissionWebhookAnnotationConflictsKey] = conflictsAnnotation(conflicts)
 	} else {
+		if len(conflicts) > 0 {
+			log.info("Resolved volume mount conflicts", "conflicts", len(conflicts), "strategy", strategy)
+			annotations[admissionWebhookAnnotationConflictsKey] = conflictsAnnotation(conflicts)
+		}
 		annotations[admissionWebhookAnnotationStatusKey] = admissionWebhookSuccessFlag
-		volumesTemplateToPatch = volumesTemplate
-		volumeMountsTemplateToPatch = volumeMountsTemplate
+		annotations[admissionWebhookAnnotationMutatedContainersKey] = containerNames(mutatingContainers(&importedPod))
+		annotations[admissionWebhookAnnotationMutatedFilesKey] = strings.Join(files, ",")
+		volumesTemplateToPatch = policy.lxcfs.volumes
+		volumeMountsToPatch = mounts
+		nodeRequirementToPatch = nodeRequirement
+		readinessGuardToPatch = policy.readinessGuard
+	}
+
+	if matched != nil {
+		annotations[admissionWebhookAnnotationPolicyKey] = matched.policyName()
+	}
+	log.decide(annotations[admissionWebhookAnnotationStatusKey], skipReason)
+
+	// record what would be mutated in audit mode, the pod is not mutated
+	if audit {
+		annotations = auditAnnotations(annotations, skipReason, volumeMountsToPatch, nodeRequirementToPatch != nil, readinessGuardToPatch != nil)
+		volumesTemplateToPatch, volumeMountsToPatch, nodeRequirementToPatch, readinessGuardToPatch = nil, nil, nil, nil
 	}
 
-	patchBytes, err := createPatch(&pod, volumesTemplateToPatch, volumeMountsTemplateToPatch, annotations)
+	patchBytes, err := createPatch(pod, basePath, volumesTemplateToPatch, volumeMountsToPatch, readinessGuardToPatch, nodeRequirementToPatch, policy.exportAnnotations(annotations))
+	if err != nil {
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	return &admissionv1.AdmissionResponse{
+		Allowed: true,
+		Patch:   patchBytes,
+		PatchType: func() *admissionv1.PatchType {
+			pt := admissionv1.PatchTypeJSONPatch
+			return &pt
+		}(),
+	}
+}
+
+// mutation process for the pods/ephemeralcontainers subresource,
+// only the newly added ephemeral containers are patched with the existing LXCFS volume
+func (whsvr *WebhookServer) mutateEphemeralContainers(log *admissionLogger, policy *webhookPolicy, admissionReview *admissionv1.AdmissionReview, pod *corev1.Pod) *admissionv1.AdmissionResponse {
+	admissionRequest := admissionReview.Request
+
+	if !ephemeralContainersMutationRequired(log.logger, policy, admissionReview) {
+		log.info("Skipping ephemeral containers mutation due to policy check")
+		log.decide(admissionWebhookSkipFlag, skipReasonPolicy)
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	var oldPod corev1.Pod
+	if err := json.Unmarshal(admissionRequest.OldObject.Raw, &oldPod); err != nil {
+		log.error("Could not unmarshal raw old object", "error", err)
+		log.decide(outcomeDecodeError, "")
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	var patches []patchOperation
+	volumeMounts := ephemeralVolumeMounts(policy.lxcfs.volumeMounts(nil))
+	for _, c := range newEphemeralContainers(pod, &oldPod) {
+		if volumeMountConflictCheck(c.container.VolumeMounts, volumeMounts) {
+			log.info("Skipping mutation for ephemeral container due to volume mount conflict", "container", c.container.Name)
+			continue
+		}
+		patches = append(patches, patchVolumeMount(c.container.VolumeMounts, volumeMounts, c.path)...)
+	}
+	if len(patches) == 0 {
+		log.decide(admissionWebhookSkipFlag, skipReasonNoContainer)
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+	log.decide(admissionWebhookSuccessFlag, "")
+
+	// the annotations can't be patched by ephemeralcontainers subresource, only logged in audit mode
+	if log.mode == policyModeAudit {
+		log.info("Skipping ephemeral containers mutation due to audit mode", "patches", len(patches))
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	patchBytes, err := json.Marshal(patches)
 	if err != nil {
 		return &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
@@ -331,6 +783,15 @@ func (whsvr *WebhookServer) mutate(admissionReview *admissionv1.AdmissionReview)
 
 // serve method for webhook server
 func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
+	ar := admissionv1.AdmissionReview{}
+	start := time.Now()
+	defer func() {
+		// the dry runs are counted by dryRunAdmissions only
+		if ar.Request == nil || !isDryRun(ar.Request) {
+			serveDuration.Observe(time.Since(start).Seconds())
+		}
+	}()
+
 	var body []byte
 	if r.Body != nil {
 		if data, err := ioutil.ReadAll(r.Body); err == nil {
@@ -338,7 +799,7 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if len(body) == 0 {
-		glog.Error("empty body")
+		defaultLogger.error("Empty body")
 		http.Error(w, "empty body", http.StatusBadRequest)
 		return
 	}
@@ -346,22 +807,23 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 	// verify the content type is accurate
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "application/json" {
-		glog.Errorf("Content-Type=%s, expect application/json", contentType)
+		defaultLogger.error("Invalid Content-Type, expect application/json", "contentType", contentType)
 		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
 		return
 	}
 
 	var admissionResponse *admissionv1.AdmissionResponse
-	ar := admissionv1.AdmissionReview{}
 	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
-		glog.Errorf("Can't decode body: %v", err)
+		defaultLogger.error("Can't decode body", "error", err)
+		recordAdmission("", outcomeDecodeError, "")
 		admissionResponse = &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
 			},
 		}
 	} else if ar.Request == nil {
-		glog.Error("Got nil admissionRequest object after deserializer http request body")
+		defaultLogger.error("Got nil admissionRequest object after deserializer http request body")
+		recordAdmission("", outcomeDecodeError, "")
 		admissionResponse = &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: "Got nil admissionRequest object after deserializer http request body",
@@ -378,6 +840,9 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 	if admissionResponse != nil {
+		if len(admissionResponse.Patch) > 0 && !isDryRun(ar.Request) {
+			patchSize.Observe(float64(len(admissionResponse.Patch)))
+		}
 		admissionReview.Response = admissionResponse
 		if ar.Request != nil {
 			admissionReview.Response.UID = ar.Request.UID
@@ -386,19 +851,19 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 
 	resp, err := json.Marshal(admissionReview)
 	if err != nil {
-		glog.Errorf("Can't encode response: %v", err)
+		defaultLogger.error("Can't encode response", "error", err)
 		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if _, err := w.Write(resp); err != nil {
-		glog.Errorf("Can't write response: %v", err)
+		defaultLogger.error("Can't write response", "error", err)
 		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
 	}
 }
 
 func (whsvr *WebhookServer) ping(w http.ResponseWriter, _ *http.Request) {
 	if _, err := fmt.Fprintf(w, "pong"); err != nil {
-		glog.Errorf("Can't write response: %v", err)
+		defaultLogger.error("Can't write response", "error", err)
 		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
 	}
 }
@@ -4,24 +4,33 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"github.com/golang/glog"
 	"gotest.tools/assert"
 	"io/ioutil"
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/klog/v2"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 )
 
+var (
+	testLxcfsMount, _    = newLxcfsMount(defaultLxcfsHostRoot, defaultLxcfsMountDir)
+	volumesTemplate      = testLxcfsMount.volumes
+	volumeMountsTemplate = testLxcfsMount.volumeMounts(lxcfsFiles)
+)
+
 func NewWebhookServer() *WebhookServer {
-	return &WebhookServer{
+	whsvr := &WebhookServer{
 		server: &http.Server{
 			Addr: fmt.Sprintf(":%v", 8080),
 		},
 	}
+	whsvr.setPolicy(defaultPolicy)
+	return whsvr
 }
 
 func GetAdmissionReviewExample() *admissionv1.AdmissionReview {
@@ -222,7 +231,7 @@ func GetAdmissionReviewExample() *admissionv1.AdmissionReview {
 
 	admissionReviewExample := admissionv1.AdmissionReview{}
 	if _, _, err := deserializer.Decode(example, nil, &admissionReviewExample); err != nil {
-		glog.Errorf("Can't decode request body: %v", err)
+		klog.Errorf("Can't decode request body: %v", err)
 	}
 
 	return &admissionReviewExample
@@ -286,8 +295,8 @@ func TestWebhookServerMutate(t *testing.T) {
 	whsvr := NewWebhookServer()
 
 	exceptSkipJsonPatch := "{\"op\":\"add\",\"path\":\"/metadata/annotations\",\"value\":{\"mutating.lxcfs-admission-webhook.io/status\":\"skip\"}}"
-	exceptMutatedJsonPatch := "{\"op\":\"add\",\"path\":\"/metadata/annotations\",\"value\":{\"mutating.lxcfs-admission-webhook.io/status\":\"mutated\"}}"
-	exceptConflictJsonPatch := "{\"op\":\"add\",\"path\":\"/metadata/annotations\",\"value\":{\"mutating.lxcfs-admission-webhook.io/status\":\"conflict\"}}"
+	exceptMutatedJsonPatch := "{\"op\":\"add\",\"path\":\"/metadata/annotations\",\"value\":{\"mutating.lxcfs-admission-webhook.io/mutated-containers\":\"nginx\",\"mutating.lxcfs-admission-webhook.io/mutated-files\":\"" + strings.Join(lxcfsFiles, ",") + "\",\"mutating.lxcfs-admission-webhook.io/status\":\"mutated\"}}"
+	exceptConflictJsonPatch := "\"mutating.lxcfs-admission-webhook.io/status\":\"conflict\"}}"
 	exceptErrorMsg := "json: cannot unmarshal array into Go value of type v1.Pod"
 
 	admissionReviewExample := GetAdmissionReviewExample()
@@ -300,6 +309,15 @@ func TestWebhookServerMutate(t *testing.T) {
 	admissionReviewExample.DeepCopyInto(&admissionReviewWithNamespaceSystem)
 	admissionReviewWithNamespaceSystem.Request.Namespace = metav1.NamespaceSystem
 
+	admissionReviewWithNoContainer := admissionReviewExample.DeepCopy()
+	var podWithNoContainer corev1.Pod
+	if err := json.Unmarshal(admissionReviewWithNoContainer.Request.Object.Raw, &podWithNoContainer); err != nil {
+		t.Error(err)
+	}
+	podWithNoContainer.SetAnnotations(map[string]string{admissionWebhookAnnotationExcludeContainersKey: "nginx"})
+	admissionReviewWithNoContainer.Request.Object.Raw, _ = json.Marshal(podWithNoContainer)
+	exceptNoContainerJsonPatch := "{\"op\":\"add\",\"path\":\"/metadata/annotations/mutating.lxcfs-admission-webhook.io~1status\",\"value\":\"skip\"}"
+
 	admissionReviewWithVolumeConflict := admissionv1.AdmissionReview{}
 	admissionReviewExample.DeepCopyInto(&admissionReviewWithVolumeConflict)
 	var podWithVolumeConflict corev1.Pod
@@ -318,6 +336,7 @@ func TestWebhookServerMutate(t *testing.T) {
 	}{
 		{"test with example data", admissionReviewExample, exceptMutatedJsonPatch},
 		{"test with kube-system namespace", &admissionReviewWithNamespaceSystem, exceptSkipJsonPatch},
+		{"test with all containers excluded", admissionReviewWithNoContainer, exceptNoContainerJsonPatch},
 		{"test with volume conflict", &admissionReviewWithVolumeConflict, exceptConflictJsonPatch},
 		{"test with error admission review", &admissionReviewWithError, exceptErrorMsg},
 	}
@@ -336,14 +355,80 @@ func TestWebhookServerMutate(t *testing.T) {
 	}
 }
 
+func TestWebhookServerMutateEphemeralContainers(t *testing.T) {
+	whsvr := NewWebhookServer()
+
+	admissionReviewExample := GetAdmissionReviewExample()
+	var oldPod corev1.Pod
+	if err := json.Unmarshal(admissionReviewExample.Request.Object.Raw, &oldPod); err != nil {
+		t.Error(err)
+	}
+	oldPod.Name = "nginx-6fc77dcb7c-4kx2m"
+	oldPod.SetAnnotations(map[string]string{admissionWebhookAnnotationStatusKey: admissionWebhookSuccessFlag})
+	oldPod.Spec.Volumes = append(oldPod.Spec.Volumes, volumesTemplate...)
+	oldPod.Spec.EphemeralContainers = []corev1.EphemeralContainer{
+		{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger-old"}},
+	}
+	pod := oldPod.DeepCopy()
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers,
+		corev1.EphemeralContainer{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger-new"}})
+
+	newAdmissionReview := func(pod, oldPod *corev1.Pod) *admissionv1.AdmissionReview {
+		ar := admissionReviewExample.DeepCopy()
+		ar.Request.Operation = admissionv1.Update
+		ar.Request.SubResource = ephemeralContainersSubResource
+		ar.Request.Name = pod.Name
+		ar.Request.Object.Raw, _ = json.Marshal(pod)
+		ar.Request.OldObject.Raw, _ = json.Marshal(oldPod)
+		return ar
+	}
+
+	podNotMutated := pod.DeepCopy()
+	podNotMutated.SetAnnotations(map[string]string{admissionWebhookAnnotationStatusKey: admissionWebhookSkipFlag})
+	oldPodNotMutated := oldPod.DeepCopy()
+	oldPodNotMutated.SetAnnotations(podNotMutated.GetAnnotations())
+
+	admissionReviewWithNamespaceSystem := newAdmissionReview(pod, &oldPod)
+	admissionReviewWithNamespaceSystem.Request.Namespace = metav1.NamespaceSystem
+
+	testCases := []struct {
+		name   string
+		ar     *admissionv1.AdmissionReview
+		except string
+	}{
+		{"test with new ephemeral container", newAdmissionReview(pod, &oldPod), "\"/spec/ephemeralContainers/1/volumeMounts\""},
+		{"test without new ephemeral container", newAdmissionReview(&oldPod, &oldPod), ""},
+		{"test with not mutated pod", newAdmissionReview(podNotMutated, oldPodNotMutated), ""},
+		{"test with kube-system namespace", admissionReviewWithNamespaceSystem, ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+
+		admissionResponse := whsvr.mutate(testCase.ar)
+		assert.Equal(t, admissionResponse.Allowed, true)
+		patch := string(admissionResponse.Patch)
+		if testCase.except == "" {
+			assert.Equal(t, patch, "")
+			continue
+		}
+		assert.Equal(t, strings.Contains(patch, testCase.except), true)
+		assert.Equal(t, strings.Contains(patch, "/spec/ephemeralContainers/0"), false)
+		assert.Equal(t, strings.Contains(patch, "subPath"), false)
+	}
+}
+
 func TestStartWebhookServer(t *testing.T) {
 	parameters := WhSvrParameters{
-		8443,
-		"../deploy/certs/server-cert.pem",
-		"../deploy/certs/server-key.pem",
+		port:     8443,
+		certFile: "../deploy/certs/server-cert.pem",
+		keyFile:  "../deploy/certs/server-key.pem",
 	}
 
-	whsvr := startWebhookServer(&parameters)
+	whsvr, err := startWebhookServer(&parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer func() {
 		_ = whsvr.server.Close()
 	}()
@@ -424,7 +509,7 @@ func TestMutationRequired(t *testing.T) {
 	}
 
 	for _, testCase := range cases {
-		assert.Equal(t, mutationRequired(ignoredNamespaces, validMutatingKindList, validMutatingOperationList, testCase.admissionReview), testCase.required)
+		assert.Equal(t, mutationRequired(defaultLogger, defaultPolicy, validMutatingKindList, validMutatingOperationList, testCase.admissionReview, nil), testCase.required)
 	}
 }
 
@@ -496,6 +581,10 @@ func TestPatchConflictCheck(t *testing.T) {
 	pod1.Spec.Volumes = volumesTemplate
 	pod2 := pod.DeepCopy()
 	pod2.Spec.Containers[0].VolumeMounts = volumeMountsTemplate
+	pod3 := pod.DeepCopy()
+	pod3.Spec.InitContainers = []corev1.Container{{Name: "init", VolumeMounts: volumeMountsTemplate}}
+	pod4 := pod3.DeepCopy()
+	pod4.SetAnnotations(map[string]string{admissionWebhookAnnotationInitContainersKey: "true"})
 
 	testCases := []struct {
 		pod      *corev1.Pod
@@ -504,10 +593,13 @@ func TestPatchConflictCheck(t *testing.T) {
 		{&pod, false},
 		{pod1, true},
 		{pod2, true},
+		{pod3, false},
+		{pod4, true},
 	}
 
 	for _, testCase := range testCases {
-		assert.Equal(t, patchConflictCheck(testCase.pod, volumesTemplate, volumeMountsTemplate), testCase.conflict)
+		_, _, conflict := patchConflictCheck(testCase.pod, volumesTemplate, volumeMountsTemplate, conflictStrategySkipPod)
+		assert.Equal(t, conflict, testCase.conflict)
 	}
 }
 
@@ -518,7 +610,8 @@ func TestCreatePatch(t *testing.T) {
 		t.Error(err)
 	}
 
-	patch, err := createPatch(&pod, volumesTemplate, volumeMountsTemplate, make(map[string]string))
+	mounts, _, _ := patchConflictCheck(&pod, volumesTemplate, volumeMountsTemplate, conflictStrategySkipPod)
+	patch, err := createPatch(&pod, "", volumesTemplate, mounts, nil, nil, make(map[string]string))
 	if err != nil {
 		t.Error(err)
 	}
@@ -526,16 +619,134 @@ func TestCreatePatch(t *testing.T) {
 	assert.Equal(t, strings.Contains(string(patch), "\"op\":\"add\""), true)
 }
 
+func TestLxcfsFilesRequired(t *testing.T) {
+	lxcfsV5 := version.MustParseGeneric("5.0.3")
+	profiles := map[string][]string{"nested": {"/proc/meminfo", "/sys/devices/system/cpu", "/sys/devices/system/cpu/online"}}
+	for name, files := range lxcfsProfiles {
+		profiles[name] = files
+	}
+
+	testCases := []struct {
+		annotations  map[string]string
+		lxcfsVersion *version.Version
+		except       []string
+		err          bool
+	}{
+		{nil, nil, lxcfsFiles, false},
+		{nil, lxcfsV5, lxcfsFiles, false},
+		{map[string]string{admissionWebhookAnnotationProfileKey: "Minimal"}, nil, []string{"/proc/cpuinfo", "/proc/meminfo"}, false},
+		{map[string]string{admissionWebhookAnnotationProfileKey: "unknown"}, nil, nil, true},
+		{map[string]string{admissionWebhookAnnotationProfileKey: lxcfsProfilePressure}, nil, nil, true},
+		{map[string]string{admissionWebhookAnnotationProfileKey: lxcfsProfilePressure}, lxcfsV5, lxcfsProfiles[lxcfsProfilePressure], false},
+		{map[string]string{
+			admissionWebhookAnnotationProfileKey: lxcfsProfileCPU,
+			admissionWebhookAnnotationFilesKey:   "/proc/meminfo, /proc/uptime,/proc/meminfo",
+		}, nil, []string{"/proc/meminfo", "/proc/uptime"}, false},
+		{map[string]string{admissionWebhookAnnotationFilesKey: "/proc/meminfo,/proc/mounts"}, nil, nil, true},
+		{map[string]string{admissionWebhookAnnotationFilesKey: "/proc/meminfo,/proc/slabinfo"}, nil, nil, true},
+		{map[string]string{admissionWebhookAnnotationFilesKey: "/proc/meminfo,/proc/slabinfo"}, lxcfsV5, []string{"/proc/meminfo", "/proc/slabinfo"}, false},
+		{map[string]string{admissionWebhookAnnotationFilesKey: ""}, nil, nil, true},
+		{map[string]string{admissionWebhookAnnotationFilesKey: "/sys/devices/system/cpu,/sys/devices/system/cpu/online"}, lxcfsV5, nil, true},
+		{map[string]string{admissionWebhookAnnotationFilesKey: "/sys/devices/system/cpu/online,/sys/devices/system/cpu"}, lxcfsV5, nil, true},
+		{map[string]string{admissionWebhookAnnotationProfileKey: "nested"}, lxcfsV5, nil, true},
+	}
+
+	for _, testCase := range testCases {
+		files, err := lxcfsFilesRequired(testCase.annotations, profiles, lxcfsProfileFull, testCase.lxcfsVersion)
+		assert.Equal(t, err != nil, testCase.err)
+		assert.DeepEqual(t, files, testCase.except)
+	}
+}
+
+func TestLxcfsMount(t *testing.T) {
+	testCases := []struct {
+		hostRoot      string
+		mountDir      string
+		err           bool
+		exceptSubPath string
+	}{
+		{defaultLxcfsHostRoot, defaultLxcfsMountDir, false, "lxcfs/proc/meminfo"},
+		{"/run/lxcfs", ".", true, ""},
+		{"/run/lxcfs", "mnt/", false, "mnt/proc/meminfo"},
+		{"/run/lxcfs", "mnt/lxcfs", false, "mnt/lxcfs/proc/meminfo"},
+		{"run", "lxcfs", true, ""},
+		{"/run/lxcfs", "/mnt", true, ""},
+		{"/run/lxcfs", "../mnt", true, ""},
+		{"/run", "lxcfs", true, ""},
+		{"/var/run/", "lxcfs", true, ""},
+		{"/var/lib", "lxcfs", true, ""},
+		{"/", "lxcfs", true, ""},
+	}
+
+	for _, testCase := range testCases {
+		m, err := newLxcfsMount(testCase.hostRoot, testCase.mountDir)
+		assert.Equal(t, err != nil, testCase.err)
+		if err != nil {
+			continue
+		}
+
+		assert.Equal(t, m.volumes[0].HostPath.Path, testCase.hostRoot)
+		volumeMounts := m.volumeMounts([]string{"/proc/meminfo"})
+		assert.Equal(t, len(volumeMounts), 2)
+		assert.Equal(t, volumeMounts[0].MountPath, "/proc/meminfo")
+		assert.Equal(t, volumeMounts[0].SubPath, testCase.exceptSubPath)
+		assert.Equal(t, volumeMounts[1].MountPath, testCase.hostRoot)
+		assert.Equal(t, volumeMounts[1].SubPath, "")
+	}
+}
+
+func TestMutatingContainers(t *testing.T) {
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init"}},
+			Containers:     []corev1.Container{{Name: "app"}, {Name: "sidecar"}},
+		},
+	}
+	podWithInitContainers := pod.DeepCopy()
+	podWithInitContainers.SetAnnotations(map[string]string{admissionWebhookAnnotationInitContainersKey: "yes"})
+	podWithInclude := pod.DeepCopy()
+	podWithInclude.SetAnnotations(map[string]string{
+		admissionWebhookAnnotationInitContainersKey:    "true",
+		admissionWebhookAnnotationIncludeContainersKey: "init, sidecar",
+	})
+	podWithExclude := pod.DeepCopy()
+	podWithExclude.SetAnnotations(map[string]string{admissionWebhookAnnotationExcludeContainersKey: "sidecar"})
+	podWithExcludeAll := pod.DeepCopy()
+	podWithExcludeAll.SetAnnotations(map[string]string{
+		admissionWebhookAnnotationIncludeContainersKey: "app",
+		admissionWebhookAnnotationExcludeContainersKey: "app",
+	})
+
+	testCases := []struct {
+		pod    *corev1.Pod
+		except []string
+	}{
+		{&pod, []string{"/spec/containers/0", "/spec/containers/1"}},
+		{podWithInitContainers, []string{"/spec/initContainers/0", "/spec/containers/0", "/spec/containers/1"}},
+		{podWithInclude, []string{"/spec/initContainers/0", "/spec/containers/1"}},
+		{podWithExclude, []string{"/spec/containers/0"}},
+		{podWithExcludeAll, nil},
+	}
+
+	for _, testCase := range testCases {
+		var paths []string
+		for _, c := range mutatingContainers(testCase.pod) {
+			paths = append(paths, c.path)
+		}
+		assert.DeepEqual(t, paths, testCase.except)
+	}
+}
+
 func TestPatchVolumeMount(t *testing.T) {
-	targetIndex := 1
+	containerPath := "/spec/initContainers/1"
 	addedVolumeMount := volumeMountsTemplate
 
 	var emptyTarget []corev1.VolumeMount
 	notEmptyTarget := addedVolumeMount
 
-	exceptEmptyTargetPatchPart := fmt.Sprintf("/spec/containers/%d/volumeMounts", targetIndex)
+	exceptEmptyTargetPatchPart := fmt.Sprintf("\"%s/volumeMounts\"", containerPath)
 
-	exceptNotEmptyTargetPatchPart := fmt.Sprintf("/spec/containers/%d/volumeMounts/-", targetIndex)
+	exceptNotEmptyTargetPatchPart := fmt.Sprintf("\"%s/volumeMounts/-\"", containerPath)
 
 	testCases := []struct {
 		target          []corev1.VolumeMount
@@ -547,7 +758,7 @@ func TestPatchVolumeMount(t *testing.T) {
 	}
 
 	for _, testCase := range testCases {
-		patch := patchVolumeMount(testCase.target, testCase.added, targetIndex)
+		patch := patchVolumeMount(testCase.target, testCase.added, containerPath)
 		patchByte, _ := json.Marshal(patch)
 		assert.Equal(t, strings.Contains(string(patchByte), testCase.exceptPatchPart), true)
 	}
@@ -585,9 +796,13 @@ func TestPatchAnnotation(t *testing.T) {
 		"foo": "bar",
 	}
 	added := notEmptyTarget
+	newAdded := map[string]string{
+		"foo/baz": "qux",
+	}
 
 	exceptEmptyTargetPatchPart := "add"
 	exceptNotEmptyTargetPatchPart := "replace"
+	exceptNewKeyPatchPart := "{\"op\":\"add\",\"path\":\"/metadata/annotations/foo~1baz\",\"value\":\"qux\"}"
 
 	testCases := []struct {
 		target          map[string]string
@@ -596,6 +811,7 @@ func TestPatchAnnotation(t *testing.T) {
 	}{
 		{emptyTarget, added, exceptEmptyTargetPatchPart},
 		{notEmptyTarget, added, exceptNotEmptyTargetPatchPart},
+		{notEmptyTarget, newAdded, exceptNewKeyPatchPart},
 	}
 
 	for _, testCase := range testCases {
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	deploymentKind  = metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	statefulSetKind = metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"}
+	daemonSetKind   = metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "DaemonSet"}
+	jobKind         = metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}
+	cronJobKind     = metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "CronJob"}
+)
+
+// validWorkloadKindList the workload kinds whose pod template can be mutated,
+// value is the JSON pointer path of the pod template in workload
+var validWorkloadKindList = map[metav1.GroupVersionKind]string{
+	deploymentKind:  "/spec/template",
+	statefulSetKind: "/spec/template",
+	daemonSetKind:   "/spec/template",
+	jobKind:         "/spec/template",
+	cronJobKind:     "/spec/jobTemplate/spec/template",
+}
+
+// pod template of workload can be mutated when create or update it
+var validWorkloadOperationList = []admissionv1.Operation{
+	admissionv1.Create,
+	admissionv1.Update,
+}
+
+// isWorkloadKind check whether the kind is a workload kind which has pod template
+func isWorkloadKind(kind metav1.GroupVersionKind) bool {
+	_, ok := validWorkloadKindList[kind]
+	return ok
+}
+
+// workloadKinds get all the workload kinds
+func workloadKinds() []metav1.GroupVersionKind {
+	kinds := make([]metav1.GroupVersionKind, 0, len(validWorkloadKindList))
+	for kind := range validWorkloadKindList {
+		kinds = append(kinds, kind)
+	}
+	return kinds
+}
+
+// workloadPodTemplate decode the workload object and get its pod template
+func workloadPodTemplate(kind metav1.GroupVersionKind, raw []byte) (*corev1.PodTemplateSpec, error) {
+	switch kind {
+	case deploymentKind:
+		var deployment appsv1.Deployment
+		if err := json.Unmarshal(raw, &deployment); err != nil {
+			return nil, err
+		}
+		return &deployment.Spec.Template, nil
+	case statefulSetKind:
+		var statefulSet appsv1.StatefulSet
+		if err := json.Unmarshal(raw, &statefulSet); err != nil {
+			return nil, err
+		}
+		return &statefulSet.Spec.Template, nil
+	case daemonSetKind:
+		var daemonSet appsv1.DaemonSet
+		if err := json.Unmarshal(raw, &daemonSet); err != nil {
+			return nil, err
+		}
+		return &daemonSet.Spec.Template, nil
+	case jobKind:
+		var job batchv1.Job
+		if err := json.Unmarshal(raw, &job); err != nil {
+			return nil, err
+		}
+		return &job.Spec.Template, nil
+	case cronJobKind:
+		var cronJob batchv1.CronJob
+		if err := json.Unmarshal(raw, &cronJob); err != nil {
+			return nil, err
+		}
+		return &cronJob.Spec.JobTemplate.Spec.Template, nil
+	}
+	return nil, nil
+}
+
+// podFromObject decode the pod, or the pod template of workload, from the admission request object,
+// return the pod and the JSON pointer path of it in the object
+func podFromObject(admissionRequest *admissionv1.AdmissionRequest) (*corev1.Pod, string, error) {
+	if basePath, ok := validWorkloadKindList[admissionRequest.Kind]; ok {
+		template, err := workloadPodTemplate(admissionRequest.Kind, admissionRequest.Object.Raw)
+		if err != nil {
+			return nil, "", err
+		}
+		return &corev1.Pod{ObjectMeta: template.ObjectMeta, Spec: template.Spec}, basePath, nil
+	}
+
+	var pod corev1.Pod
+	if err := json.Unmarshal(admissionRequest.Object.Raw, &pod); err != nil {
+		return nil, "", err
+	}
+	return &pod, "", nil
+}
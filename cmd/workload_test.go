@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func workloadPodTemplateExample() corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{"app": "nginx"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "nginx", Image: "nginx:1.21"}},
+		},
+	}
+}
+
+func workloadAdmissionReview(t *testing.T, kind metav1.GroupVersionKind, operation admissionv1.Operation, object interface{}) *admissionv1.AdmissionReview {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		t.Error(err)
+	}
+
+	ar := GetAdmissionReviewExample()
+	ar.Request.Kind = kind
+	ar.Request.Operation = operation
+	ar.Request.Name = "nginx"
+	ar.Request.Object.Raw = raw
+	return ar
+}
+
+func TestPodFromObject(t *testing.T) {
+	deployment := appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: workloadPodTemplateExample()}}
+	cronJob := batchv1.CronJob{
+		Spec: batchv1.CronJobSpec{
+			JobTemplate: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{Template: workloadPodTemplateExample()},
+			},
+		},
+	}
+
+	testCases := []struct {
+		ar       *admissionv1.AdmissionReview
+		basePath string
+	}{
+		{GetAdmissionReviewExample(), ""},
+		{workloadAdmissionReview(t, deploymentKind, admissionv1.Create, deployment), "/spec/template"},
+		{workloadAdmissionReview(t, cronJobKind, admissionv1.Create, cronJob), "/spec/jobTemplate/spec/template"},
+	}
+
+	for _, testCase := range testCases {
+		pod, basePath, err := podFromObject(testCase.ar.Request)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, basePath, testCase.basePath)
+		assert.Equal(t, pod.Spec.Containers[0].Name, "nginx")
+	}
+}
+
+func TestWebhookServerMutateWorkloads(t *testing.T) {
+	whsvr := NewWebhookServer()
+
+	statefulSet := appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Template: workloadPodTemplateExample()}}
+	mutatedStatefulSet := statefulSet.DeepCopy()
+	mutatedStatefulSet.Spec.Template.Annotations = map[string]string{
+		admissionWebhookAnnotationStatusKey: admissionWebhookSuccessFlag,
+	}
+	job := batchv1.Job{Spec: batchv1.JobSpec{Template: workloadPodTemplateExample()}}
+
+	testCases := []struct {
+		name            string
+		mutateWorkloads bool
+		ar              *admissionv1.AdmissionReview
+		except          []string
+	}{
+		{"test with mutating workloads disabled", false, workloadAdmissionReview(t, statefulSetKind, admissionv1.Create, statefulSet), nil},
+		{"test with create statefulset", true, workloadAdmissionReview(t, statefulSetKind, admissionv1.Create, statefulSet), []string{
+			"\"/spec/template/spec/containers/0/volumeMounts\"",
+			"\"/spec/template/spec/volumes\"",
+			"\"/spec/template/metadata/annotations\"",
+		}},
+		{"test with update job", true, workloadAdmissionReview(t, jobKind, admissionv1.Update, job), []string{
+			"\"/spec/template/spec/containers/0/volumeMounts\"",
+		}},
+		{"test with delete job", true, workloadAdmissionReview(t, jobKind, admissionv1.Delete, job), []string{
+			"\"/spec/template/metadata/annotations\",\"value\":{\"mutating.lxcfs-admission-webhook.io/status\":\"skip\"}",
+		}},
+		{"test with mutated statefulset", true, workloadAdmissionReview(t, statefulSetKind, admissionv1.Update, mutatedStatefulSet), nil},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Test case for: %s", testCase.name)
+
+		policy, err := newWebhookPolicy(webhookConfig{MutateWorkloads: testCase.mutateWorkloads})
+		if err != nil {
+			t.Error(err)
+		}
+		whsvr.setPolicy(policy)
+		admissionResponse := whsvr.mutate(testCase.ar)
+		assert.Equal(t, admissionResponse.Allowed, true)
+		patch := string(admissionResponse.Patch)
+		if testCase.except == nil {
+			assert.Equal(t, patch, "")
+			continue
+		}
+		for _, except := range testCase.except {
+			assert.Equal(t, strings.Contains(patch, except), true, "patch %s not contain %s", patch, except)
+		}
+	}
+}
+
+func TestWebhookServerMutateMutatedPod(t *testing.T) {
+	whsvr := NewWebhookServer()
+
+	ar := GetAdmissionReviewExample()
+	var pod corev1.Pod
+	if err := json.Unmarshal(ar.Request.Object.Raw, &pod); err != nil {
+		t.Error(err)
+	}
+	pod.SetAnnotations(map[string]string{admissionWebhookAnnotationStatusKey: admissionWebhookSuccessFlag})
+	ar.Request.Object.Raw, _ = json.Marshal(pod)
+
+	admissionResponse := whsvr.mutate(ar)
+	assert.Equal(t, admissionResponse.Allowed, true)
+	assert.Equal(t, len(admissionResponse.Patch), 0)
+}
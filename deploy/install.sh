@@ -16,6 +16,7 @@ defined resources name:
   --mutating          mutating admission name, default: lxcfs-admission-webhook
 
   --create-cert-only  generate a self-signed certificate in current directory
+  --self-managed-cert the webhook generates and rotates its certificate in the secret, and patches the caBundle
 
 EOF
 }
@@ -28,7 +29,7 @@ to help see right container's limitations in the container.
 This script will:
 1. create deployment of lxcfs daemonset
 2. create admission webhook cert stored in a k8s secret
-3. create deployment of dynamic admission webhook for patch lxcfs volume for container
+3. create LxcfsPolicy CRDs and deployment of dynamic admission webhook for patch lxcfs volume for container
 4. create k8s MutatingWebhookConfiguration
 
 about lxcfs:
@@ -111,25 +112,36 @@ create_k8s_resources() {
   export WH_SECRET
   export MUTATING_WH_CONFIG
   export LXCFS_DS
+  export SELF_MANAGED_CERT
+  # the lxcfs image tag built by make build-image-lxcfs
+  LXCFS_VERSION=$(source "$PWD"/../lxcfs-image/.env && echo "${LXCFS_VERSION}")
+  export LXCFS_VERSION
 
   # 1 Deploy lxcfs daemonset
   envsubst <"$PWD"/lxcfs-daemonset.tpl.yaml | kubectl create -n "${NAMESPACE}" -o yaml --dry-run=client -f - | kubectl -n "${NAMESPACE}" apply -f -
 
-  # 2 Create admission webhook cert
-  CERT_DIR=$(mktemp -d)
-  create_self_signed_cert
-  kubectl create secret generic "${WH_SECRET}" -n "${NAMESPACE}" \
-    --from-file=tls.key="${CERT_DIR}"/server-key.pem \
-    --from-file=tls.crt="${CERT_DIR}"/server-cert.pem \
-    --dry-run=client -o yaml |
-    kubectl -n "${NAMESPACE}" apply -f -
+  # 2 Create admission webhook cert, the self-managed cert is created by webhook
+  if [[ ${SELF_MANAGED_CERT} == false ]]; then
+    CERT_DIR=$(mktemp -d)
+    create_self_signed_cert
+    kubectl create secret generic "${WH_SECRET}" -n "${NAMESPACE}" \
+      --from-file=tls.key="${CERT_DIR}"/server-key.pem \
+      --from-file=tls.crt="${CERT_DIR}"/server-cert.pem \
+      --dry-run=client -o yaml |
+      kubectl -n "${NAMESPACE}" apply -f -
+  fi
 
   # 3 Deploy admission webhook
+  kubectl apply -f "$PWD"/lxcfspolicy-crd.yaml
+  envsubst <"$PWD"/rbac.tpl.yaml | kubectl create -n "${NAMESPACE}" -o yaml --dry-run=client -f - | kubectl -n "${NAMESPACE}" apply -f -
   envsubst <"$PWD"/deployment.tpl.yaml | kubectl create -n "${NAMESPACE}" -o yaml --dry-run=client -f - | kubectl -n "${NAMESPACE}" apply -f -
   envsubst <"$PWD"/service.tpl.yaml | kubectl create -n "${NAMESPACE}" -o yaml --dry-run=client -f - | kubectl -n "${NAMESPACE}" apply -f -
 
-  # 4 Create k8s MutatingWebhookConfiguration
-  CA_BUNDLE=$(base64 <"${CERT_DIR}"/ca-cert.pem | tr -d '\n')
+  # 4 Create k8s MutatingWebhookConfiguration, the caBundle of self-managed cert is patched by webhook
+  CA_BUNDLE=""
+  if [[ ${SELF_MANAGED_CERT} == false ]]; then
+    CA_BUNDLE=$(base64 <"${CERT_DIR}"/ca-cert.pem | tr -d '\n')
+  fi
   export CA_BUNDLE
   envsubst <"$PWD"/mutatingwebhook.tpl.yaml | kubectl create -o yaml --dry-run=client -f - | kubectl apply -f -
 }
@@ -143,6 +155,7 @@ main() {
   MUTATING_WH_CONFIG=lxcfs-admission-webhook
   LXCFS_DS=lxcfs-ds
   CREATE_CERT_ONLY=false
+  SELF_MANAGED_CERT=false
 
   if [[ $# -ge 1 ]]; then
     case $1 in
@@ -174,6 +187,10 @@ main() {
       CREATE_CERT_ONLY=true
       shift
       ;;
+    --self-managed-cert)
+      SELF_MANAGED_CERT=true
+      shift
+      ;;
     --help | -h)
       help
       exit 0
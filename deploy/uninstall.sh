@@ -56,8 +56,15 @@ EOF
   kubectl delete mutatingwebhookconfigurations.admissionregistration.k8s.io "${MUTATING_WH_CONFIG}"
   kubectl delete -n "${NAMESPACE}" services "${WH_SVC}"
   kubectl delete -n "${NAMESPACE}" deployments.apps "${WH_DEP}"
+  kubectl delete -n "${NAMESPACE}" serviceaccounts "${WH_DEP}" --ignore-not-found
+  kubectl delete -n "${NAMESPACE}" roles.rbac.authorization.k8s.io,rolebindings.rbac.authorization.k8s.io "${WH_DEP}" --ignore-not-found
+  kubectl delete clusterroles.rbac.authorization.k8s.io,clusterrolebindings.rbac.authorization.k8s.io "${WH_DEP}" --ignore-not-found
   kubectl delete -n "${NAMESPACE}" secrets "${WH_SECRET}"
   kubectl delete -n "${NAMESPACE}" daemonsets.apps "${LXCFS_DS}"
+  kubectl delete -n "${NAMESPACE}" serviceaccounts "${LXCFS_DS}" --ignore-not-found
+  kubectl delete clusterroles.rbac.authorization.k8s.io,clusterrolebindings.rbac.authorization.k8s.io "${LXCFS_DS}" --ignore-not-found
+
+  echo "The LxcfsPolicy CRDs are kept, delete them and all the policies by: kubectl delete -f lxcfspolicy-crd.yaml"
 }
 
 main() {